@@ -0,0 +1,65 @@
+// Package audit records who did what, through the API or automatically, in
+// the append-only audit log of the storage backend.
+package audit
+
+import (
+	"log/slog"
+	"time"
+	"watchdog/logging"
+	"watchdog/models"
+	"watchdog/storage"
+)
+
+// Actors of actions that do not come from the API
+const (
+	// ActorWatchdog takes the automatic enforcement actions
+	ActorWatchdog = "watchdog"
+	// ActorCLI runs the management commands
+	ActorCLI = "cli"
+)
+
+// Actions
+const (
+	UserAdd      = "user.add"
+	UserDelete   = "user.delete"
+	UserLimit    = "user.limit"
+	UserWarn     = "user.warn"
+	UserDisable  = "user.disable"
+	UserEnable   = "user.enable"
+	UserRevoke   = "user.revoke_sub"
+	IPBlock      = "ip.block"
+	IPUnblock    = "ip.unblock"
+	LogLevel     = "log.level"
+	APIKeyCreate = "apikey.create"
+	APIKeyRevoke = "apikey.revoke"
+)
+
+// Log writes audit entries to storage
+type Log struct {
+	store storage.Store
+}
+
+// New returns a Log that appends to store
+func New(store storage.Store) *Log {
+	return &Log{store: store}
+}
+
+// Record appends an entry for an action by actor on target. err is the
+// outcome of the action. A failure to write the entry is logged, it never
+// fails the action itself.
+func (l *Log) Record(actor, action, target, reason string, err error) {
+	l.Append(models.AuditEntry{Actor: actor, Action: action, Target: target, Reason: reason}, err)
+}
+
+// Append sets the time and result of entry from err and appends it
+func (l *Log) Append(entry models.AuditEntry, err error) {
+	entry.Time = time.Now().UTC()
+	entry.Result = models.AuditSuccess
+	if err != nil {
+		entry.Result = models.AuditFailure
+		entry.Error = err.Error()
+	}
+	if err := l.store.AppendAudit(entry); err != nil {
+		slog.Error("Failed to write audit log", "action", entry.Action, "actor", entry.Actor, "target", entry.Target, logging.KeyError, err)
+	}
+}
@@ -0,0 +1,196 @@
+// Package auth protects the HTTP API with API keys and JWTs.
+//
+// Every route requires a minimum Role. Static API keys are created on the
+// command line and only their hashes are stored; JWTs are signed with
+// API_JWT_SECRET and issued by the login endpoint or the command line.
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"watchdog/logging"
+	"watchdog/storage"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Role decides which routes a caller may use. Each role includes the ones
+// below it.
+type Role int
+
+const (
+	// ReadOnly can read users, bans, streams and metrics
+	ReadOnly Role = iota + 1
+	// Operator can also add and delete users and block and unblock IPs
+	Operator
+	// Admin can also change settings such as the log level
+	Admin
+)
+
+var roleNames = map[Role]string{
+	ReadOnly: "read-only",
+	Operator: "operator",
+	Admin:    "admin",
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// ParseRole returns the role called name
+func ParseRole(name string) (Role, error) {
+	for role, n := range roleNames {
+		if n == name {
+			return role, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid role %q, must be read-only, operator or admin", name)
+}
+
+// issuer is the iss claim of the JWTs Watchdog signs
+const issuer = "watchdog"
+
+var (
+	// ErrUnauthenticated is returned for missing, unknown or expired credentials
+	ErrUnauthenticated = errors.New("missing or invalid credentials")
+	// ErrTokensDisabled is returned when issuing a JWT without API_JWT_SECRET
+	ErrTokensDisabled = errors.New("JWTs are disabled, API_JWT_SECRET is not set")
+)
+
+// Identity is the caller of a request
+type Identity struct {
+	// Subject is "key:<name>" for API keys and the subject of JWTs
+	Subject string
+	Role    Role
+}
+
+// identityKey stores the Identity in the fiber.Ctx locals
+const identityKey = "auth.identity"
+
+// FromContext returns the caller of a request that passed Require
+func FromContext(c *fiber.Ctx) (Identity, bool) {
+	id, ok := c.Locals(identityKey).(Identity)
+	return id, ok
+}
+
+// Authenticator checks the credentials of API requests
+type Authenticator struct {
+	store   storage.Store
+	enabled bool
+	secret  []byte
+	ttl     time.Duration
+}
+
+// New returns an Authenticator that looks API keys up in store and signs
+// JWTs valid for ttl with secret. JWTs are disabled when secret is empty.
+// When enabled is false every request is let through as an admin.
+func New(store storage.Store, enabled bool, secret string, ttl time.Duration) *Authenticator {
+	return &Authenticator{store: store, enabled: enabled, secret: []byte(secret), ttl: ttl}
+}
+
+// Require returns a middleware that only lets requests through whose
+// credentials carry at least role. Credentials are read from the
+// "Authorization: Bearer" header or the X-API-Key header.
+func (a *Authenticator) Require(role Role) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !a.enabled {
+			c.Locals(identityKey, Identity{Subject: "anonymous", Role: Admin})
+			return c.Next()
+		}
+
+		id, err := a.Authenticate(credential(c))
+		if errors.Is(err, ErrUnauthenticated) {
+			c.Set(fiber.HeaderWWWAuthenticate, "Bearer")
+			return c.Status(401).SendString("Unauthorized")
+		}
+		if err != nil {
+			slog.Error("Failed to check API credentials", logging.KeyError, err)
+			return c.Status(500).SendString("Failed to check credentials")
+		}
+		if id.Role < role {
+			return c.Status(403).SendString("Forbidden")
+		}
+
+		c.Locals(identityKey, id)
+		return c.Next()
+	}
+}
+
+// credential returns the API key or JWT sent with the request
+func credential(c *fiber.Ctx) string {
+	if scheme, value, ok := strings.Cut(c.Get(fiber.HeaderAuthorization), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(value)
+	}
+	return c.Get("X-API-Key")
+}
+
+// Authenticate returns the identity of an API key or JWT. It fails with
+// ErrUnauthenticated when the credential is not valid.
+func (a *Authenticator) Authenticate(credential string) (Identity, error) {
+	if credential == "" {
+		return Identity{}, ErrUnauthenticated
+	}
+	if strings.HasPrefix(credential, keyPrefix) {
+		return a.checkKey(credential)
+	}
+	return a.parseToken(credential)
+}
+
+// claims are the claims of the JWTs Watchdog signs
+type claims struct {
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// Issue signs a JWT for subject with role. It returns the token and when it
+// expires.
+func (a *Authenticator) Issue(subject string, role Role) (string, time.Time, error) {
+	if len(a.secret) == 0 {
+		return "", time.Time{}, ErrTokensDisabled
+	}
+
+	now := time.Now()
+	expires := now.Add(a.ttl)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims{
+		Role: role.String(),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   subject,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+	})
+	signed, err := token.SignedString(a.secret)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to sign token: %w", err)
+	}
+	return signed, expires, nil
+}
+
+// parseToken verifies a JWT signed by Issue
+func (a *Authenticator) parseToken(token string) (Identity, error) {
+	if len(a.secret) == 0 {
+		return Identity{}, ErrUnauthenticated
+	}
+
+	var c claims
+	_, err := jwt.ParseWithClaims(token, &c, func(*jwt.Token) (interface{}, error) {
+		return a.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(issuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return Identity{}, ErrUnauthenticated
+	}
+
+	role, err := ParseRole(c.Role)
+	if err != nil {
+		return Identity{}, ErrUnauthenticated
+	}
+	return Identity{Subject: c.Subject, Role: role}, nil
+}
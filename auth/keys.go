@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"watchdog/models"
+	"watchdog/storage"
+)
+
+// API keys look like "wd_<id>_<secret>". The ID finds the stored key, the
+// secret is compared with its hash.
+const keyPrefix = "wd_"
+
+// NewKey generates an API key called name with role. It returns the record
+// to store and the key itself, which cannot be recovered from the record.
+func NewKey(name string, role Role) (models.APIKey, string, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return models.APIKey{}, "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return models.APIKey{}, "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+
+	record := models.APIKey{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		Role:      role.String(),
+		Hash:      hashSecret(base64.RawURLEncoding.EncodeToString(secret)),
+		CreatedAt: time.Now(),
+	}
+	key := keyPrefix + record.ID + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	return record, key, nil
+}
+
+// hashSecret returns the stored form of a key secret. The secrets are random,
+// so a plain SHA-256 is enough.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkKey looks an API key up and compares its secret with the stored hash
+func (a *Authenticator) checkKey(key string) (Identity, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(key, keyPrefix), "_")
+	if !ok || id == "" || secret == "" {
+		return Identity{}, ErrUnauthenticated
+	}
+
+	record, err := a.store.GetAPIKey(id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return Identity{}, ErrUnauthenticated
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(record.Hash)) != 1 {
+		return Identity{}, ErrUnauthenticated
+	}
+
+	role, err := ParseRole(record.Role)
+	if err != nil {
+		return Identity{}, fmt.Errorf("API key %s: %w", record.ID, err)
+	}
+	return Identity{Subject: "key:" + record.Name, Role: role}, nil
+}
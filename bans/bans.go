@@ -0,0 +1,204 @@
+// Package bans blocks IPs in storage and in the firewall and lifts the bans
+// when they expire.
+package bans
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+	"watchdog/audit"
+	"watchdog/firewall"
+	"watchdog/logging"
+	"watchdog/metrics"
+	"watchdog/models"
+	"watchdog/notify"
+	"watchdog/storage"
+	"watchdog/whitelist"
+)
+
+// ErrWhitelisted is returned when banning a whitelisted IP
+var ErrWhitelisted = errors.New("IP is whitelisted")
+
+// Manager owns the blocked IPs. Each temporary ban has a timer that unblocks
+// the IP when BannedAt + BanTime passes.
+type Manager struct {
+	store     storage.Store
+	firewall  firewall.Backend
+	notifier  notify.Notifier
+	whitelist *whitelist.Whitelist
+	audit     *audit.Log
+
+	mu             sync.Mutex
+	defaultBanTime time.Duration
+	timers         map[string]*time.Timer
+}
+
+// New returns a Manager that bans for defaultBanTime unless told otherwise and
+// refuses to ban IPs in wl. Expired bans are recorded in auditLog.
+func New(store storage.Store, fw firewall.Backend, notifier notify.Notifier, wl *whitelist.Whitelist, auditLog *audit.Log, defaultBanTime time.Duration) *Manager {
+	return &Manager{
+		store:          store,
+		firewall:       fw,
+		notifier:       notifier,
+		whitelist:      wl,
+		audit:          auditLog,
+		defaultBanTime: defaultBanTime,
+		timers:         make(map[string]*time.Timer),
+	}
+}
+
+// SetDefaultBanTime changes the length of bans made without a duration. Bans
+// already made keep their length.
+func (m *Manager) SetDefaultBanTime(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.defaultBanTime = d
+}
+
+// Restore reloads the bans from storage after a restart. Bans that expired
+// while Watchdog was down are lifted, the firewall is rebuilt with the
+// remaining ones and their expiry is scheduled again.
+func (m *Manager) Restore() error {
+	blockedIPs, err := m.store.ListBlockedIPs()
+	if err != nil {
+		return fmt.Errorf("failed to read blocked IPs: %w", err)
+	}
+
+	now := time.Now()
+	active := make([]models.BlockedIP, 0, len(blockedIPs))
+	for _, blocked := range blockedIPs {
+		if !blocked.Permanent() && !now.Before(blocked.ExpiresAt()) {
+			err := m.store.UnblockIP(blocked.IP)
+			m.audit.Record(audit.ActorWatchdog, audit.IPUnblock, blocked.IP, "ban expired while Watchdog was stopped", err)
+			if err != nil {
+				return err
+			}
+			slog.Info("Ban expired while Watchdog was stopped", logging.KeyIP, blocked.IP)
+			continue
+		}
+		active = append(active, blocked)
+	}
+
+	ips := make([]string, 0, len(active))
+	for _, blocked := range active {
+		ips = append(ips, blocked.IP)
+	}
+	if err := m.firewall.Setup(ips); err != nil {
+		return fmt.Errorf("failed to set up firewall: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, blocked := range active {
+		m.schedule(blocked)
+	}
+	return nil
+}
+
+// Ban blocks ip for duration. A zero duration uses the default ban time and a
+// negative one bans permanently. Banning an IP again replaces its ban.
+// Whitelisted IPs are refused with ErrWhitelisted.
+func (m *Manager) Ban(ip string, duration time.Duration) (models.BlockedIP, error) {
+	if m.whitelist.Contains(ip) {
+		return models.BlockedIP{}, fmt.Errorf("%s: %w", ip, ErrWhitelisted)
+	}
+	if duration == 0 {
+		m.mu.Lock()
+		duration = m.defaultBanTime
+		m.mu.Unlock()
+	}
+	blocked := models.BlockedIP{
+		IP:       ip,
+		BannedAt: time.Now().Unix(),
+	}
+	if duration > 0 {
+		// BanTime is stored in whole minutes, round up so a ban is never shorter
+		blocked.BanTime = int((duration + time.Minute - 1) / time.Minute)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.store.BlockIP(blocked); err != nil {
+		return blocked, err
+	}
+	if err := m.firewall.Block(ip); err != nil {
+		return blocked, fmt.Errorf("IP stored as blocked but the firewall rule could not be added: %w", err)
+	}
+	m.schedule(blocked)
+	metrics.Bans.Inc()
+
+	if blocked.Permanent() {
+		notify.Notifyf(m.notifier, notify.IPBanned, "%s is banned permanently", ip)
+	} else {
+		notify.Notifyf(m.notifier, notify.IPBanned, "%s is banned until %s", ip, blocked.ExpiresAt().Format(time.RFC3339))
+	}
+	return blocked, nil
+}
+
+// Unban lifts the ban of ip
+func (m *Manager) Unban(ip string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.unban(ip)
+}
+
+func (m *Manager) unban(ip string) error {
+	if timer, ok := m.timers[ip]; ok {
+		timer.Stop()
+		delete(m.timers, ip)
+	}
+	if err := m.firewall.Unblock(ip); err != nil {
+		return fmt.Errorf("failed to remove firewall rule: %w", err)
+	}
+	if err := m.store.UnblockIP(ip); err != nil {
+		return err
+	}
+	notify.Notifyf(m.notifier, notify.IPUnbanned, "%s is no longer banned", ip)
+	return nil
+}
+
+// Stop cancels the expiry timers. The bans stay in storage and are picked up
+// again by Restore.
+func (m *Manager) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for ip, timer := range m.timers {
+		timer.Stop()
+		delete(m.timers, ip)
+	}
+}
+
+// schedule (re)arms the expiry timer of a temporary ban. m.mu must be held.
+func (m *Manager) schedule(blocked models.BlockedIP) {
+	if timer, ok := m.timers[blocked.IP]; ok {
+		timer.Stop()
+		delete(m.timers, blocked.IP)
+	}
+	if blocked.Permanent() {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(blocked.ExpiresAt()), func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		// The IP may have been unbanned or banned again since
+		if m.timers[blocked.IP] != timer {
+			return
+		}
+		err := m.unban(blocked.IP)
+		m.audit.Record(audit.ActorWatchdog, audit.IPUnblock, blocked.IP, "ban expired", err)
+		if err != nil {
+			slog.Error("Failed to lift expired ban", logging.KeyIP, blocked.IP, logging.KeyError, err)
+			return
+		}
+		slog.Info("Ban expired", logging.KeyIP, blocked.IP)
+	})
+	m.timers[blocked.IP] = timer
+}
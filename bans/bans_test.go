@@ -0,0 +1,162 @@
+package bans
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+	"watchdog/audit"
+	"watchdog/firewall"
+	"watchdog/models"
+	"watchdog/notify"
+	"watchdog/storage"
+	"watchdog/storage/storagetest"
+	"watchdog/whitelist"
+)
+
+// newTestManager returns a Manager that bans for an hour by default and never
+// bans 10.0.0.0/8, with the iptables backend recording its commands
+func newTestManager(t *testing.T, store storage.Store) (*Manager, *firewall.Recorder) {
+	t.Helper()
+	recorder := &firewall.Recorder{}
+	fw, err := firewall.NewWithRunner("iptables", recorder)
+	if err != nil {
+		t.Fatalf("NewWithRunner() error = %v", err)
+	}
+	wl, err := whitelist.Parse("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("whitelist.Parse() error = %v", err)
+	}
+	m := New(store, fw, notify.Nop{}, wl, audit.New(store), time.Hour)
+	t.Cleanup(m.Stop)
+	return m, recorder
+}
+
+func blockedIPs(t *testing.T, store storage.Store) []string {
+	t.Helper()
+	blocked, err := store.ListBlockedIPs()
+	if err != nil {
+		t.Fatalf("ListBlockedIPs() error = %v", err)
+	}
+	var ips []string
+	for _, b := range blocked {
+		ips = append(ips, b.IP)
+	}
+	slices.Sort(ips)
+	return ips
+}
+
+func TestRestoreAndExpiry(t *testing.T) {
+	store := storagetest.NewJSONStore(t)
+	m, recorder := newTestManager(t, store)
+	now := time.Now().Unix()
+	stored := []models.BlockedIP{
+		// Expired while Watchdog was stopped
+		{IP: "1.1.1.1", BannedAt: now - 3600, BanTime: 1},
+		// Expires within a second
+		{IP: "2.2.2.2", BannedAt: now - 59, BanTime: 1},
+		{IP: "3.3.3.3", BannedAt: now},
+	}
+	for _, blocked := range stored {
+		if err := store.BlockIP(blocked); err != nil {
+			t.Fatalf("BlockIP() error = %v", err)
+		}
+	}
+
+	if err := m.Restore(); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	commands := recorder.Commands()
+	for _, want := range []string{
+		"iptables -N WATCHDOG",
+		"ip6tables -N WATCHDOG",
+		"iptables -A WATCHDOG -s 2.2.2.2 -j DROP",
+		"iptables -A WATCHDOG -s 3.3.3.3 -j DROP",
+	} {
+		if !slices.Contains(commands, want) {
+			t.Errorf("commands after Restore() = %q, missing %q", commands, want)
+		}
+	}
+	if slices.Contains(commands, "iptables -A WATCHDOG -s 1.1.1.1 -j DROP") {
+		t.Errorf("the expired ban of 1.1.1.1 was restored")
+	}
+	if ips := blockedIPs(t, store); !slices.Equal(ips, []string{"2.2.2.2", "3.3.3.3"}) {
+		t.Errorf("blocked IPs = %v, want the expired ban removed", ips)
+	}
+
+	// The expiry is audited last, after the rule and the stored ban are gone
+	var entries []models.AuditEntry
+	deadline := time.Now().Add(3 * time.Second)
+	for len(entries) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("ban of 2.2.2.2 did not expire, commands = %q", recorder.Commands())
+		}
+		time.Sleep(10 * time.Millisecond)
+		var err error
+		if entries, err = store.ListAudit(storage.AuditFilter{Action: audit.IPUnblock}); err != nil {
+			t.Fatalf("ListAudit() error = %v", err)
+		}
+	}
+	if entries[0].Target != "2.2.2.2" || entries[1].Target != "1.1.1.1" {
+		t.Errorf("unblock entries = %+v, want 1.1.1.1 then 2.2.2.2", entries)
+	}
+	if !slices.Contains(recorder.Commands(), "iptables -D WATCHDOG -s 2.2.2.2 -j DROP") {
+		t.Errorf("commands = %q, missing the removal of 2.2.2.2", recorder.Commands())
+	}
+	if ips := blockedIPs(t, store); !slices.Equal(ips, []string{"3.3.3.3"}) {
+		t.Errorf("blocked IPs = %v, want only the permanent ban", ips)
+	}
+}
+
+func TestBan(t *testing.T) {
+	store := storagetest.NewJSONStore(t)
+	m, recorder := newTestManager(t, store)
+
+	blocked, err := m.Ban("4.4.4.4", 90*time.Second)
+	if err != nil {
+		t.Fatalf("Ban() error = %v", err)
+	}
+	if blocked.BanTime != 2 {
+		t.Errorf("BanTime = %d, want 90 seconds rounded up to 2 minutes", blocked.BanTime)
+	}
+	if commands := recorder.Commands(); !slices.Equal(commands, []string{
+		"iptables -D WATCHDOG -s 4.4.4.4 -j DROP",
+		"iptables -A WATCHDOG -s 4.4.4.4 -j DROP",
+	}) {
+		t.Errorf("commands = %q, want the rule of 4.4.4.4", commands)
+	}
+
+	if blocked, err := m.Ban("5.5.5.5", 0); err != nil || blocked.BanTime != 60 {
+		t.Errorf("Ban() with the default = %+v, %v, want 60 minutes", blocked, err)
+	}
+	if blocked, err := m.Ban("6.6.6.6", -1); err != nil || !blocked.Permanent() {
+		t.Errorf("Ban() with a negative duration = %+v, %v, want a permanent ban", blocked, err)
+	}
+
+	if err := m.Unban("4.4.4.4"); err != nil {
+		t.Fatalf("Unban() error = %v", err)
+	}
+	m.mu.Lock()
+	_, scheduled := m.timers["4.4.4.4"]
+	m.mu.Unlock()
+	if scheduled {
+		t.Error("the expiry of 4.4.4.4 is still scheduled after Unban()")
+	}
+	if ips := blockedIPs(t, store); !slices.Equal(ips, []string{"5.5.5.5", "6.6.6.6"}) {
+		t.Errorf("blocked IPs = %v, want 5.5.5.5 and 6.6.6.6", ips)
+	}
+}
+
+func TestBanWhitelisted(t *testing.T) {
+	store := storagetest.NewJSONStore(t)
+	m, recorder := newTestManager(t, store)
+	if _, err := m.Ban("10.1.2.3", 0); !errors.Is(err, ErrWhitelisted) {
+		t.Fatalf("Ban() error = %v, want ErrWhitelisted", err)
+	}
+	if commands := recorder.Commands(); len(commands) != 0 {
+		t.Errorf("commands = %q, want none", commands)
+	}
+	if ips := blockedIPs(t, store); len(ips) != 0 {
+		t.Errorf("blocked IPs = %v, want none", ips)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"watchdog/audit"
+	"watchdog/auth"
+	"watchdog/config"
+	"watchdog/storage"
+)
+
+const commandsUsage = `Commands:
+  apikey create -name NAME [-role read-only|operator|admin]
+  apikey list
+  apikey revoke ID
+  token -subject NAME [-role read-only|operator|admin]`
+
+// runCommand runs a management command given on the command line instead of
+// the service
+func runCommand(cfg *config.Config, args []string) error {
+	switch args[0] {
+	case "apikey":
+		return apiKeyCommand(cfg, args[1:])
+	case "token":
+		return tokenCommand(cfg, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q, run with -h for usage", args[0])
+	}
+}
+
+// apiKeyCommand creates, lists and revokes API keys
+func apiKeyCommand(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: apikey create|list|revoke, run with -h for details")
+	}
+	store, err := storage.New(cfg.Storage)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+		name := flags.String("name", "", "name of the key, e.g. the service using it")
+		roleName := flags.String("role", auth.ReadOnly.String(), "role of the key")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *name == "" {
+			return errors.New("-name is required")
+		}
+		role, err := auth.ParseRole(*roleName)
+		if err != nil {
+			return err
+		}
+
+		record, key, err := auth.NewKey(*name, role)
+		if err != nil {
+			return err
+		}
+		err = store.AddAPIKey(record)
+		audit.New(store).Record(audit.ActorCLI, audit.APIKeyCreate, record.ID, fmt.Sprintf("%s, %s", record.Name, record.Role), err)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created API key %s (%s, %s). It is shown only once:\n%s\n", record.ID, record.Name, record.Role, key)
+	case "list":
+		keys, err := store.ListAPIKeys()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tROLE\tCREATED")
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", key.ID, key.Name, key.Role, key.CreatedAt.Format("2006-01-02 15:04"))
+		}
+		return w.Flush()
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New("usage: apikey revoke ID")
+		}
+		if _, err := store.GetAPIKey(args[1]); err != nil {
+			return err
+		}
+		err := store.DeleteAPIKey(args[1])
+		audit.New(store).Record(audit.ActorCLI, audit.APIKeyRevoke, args[1], "", err)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Revoked API key %s\n", args[1])
+	default:
+		return fmt.Errorf("unknown apikey command %q, run with -h for usage", args[0])
+	}
+	return nil
+}
+
+// tokenCommand issues a JWT, e.g. for a service that cannot store an API key
+func tokenCommand(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("token", flag.ContinueOnError)
+	subject := flags.String("subject", "", "who the token is for")
+	roleName := flags.String("role", auth.ReadOnly.String(), "role of the token")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *subject == "" {
+		return errors.New("-subject is required")
+	}
+	role, err := auth.ParseRole(*roleName)
+	if err != nil {
+		return err
+	}
+
+	token, expires, err := auth.New(nil, true, cfg.API.JWTSecret, cfg.API.TokenTTL).Issue(*subject, role)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Token for %s (%s), valid until %s:\n%s\n", *subject, role, expires.Format("2006-01-02 15:04"), token)
+	return nil
+}
@@ -0,0 +1,220 @@
+// Package config loads the Watchdog settings at startup and reloads them
+// when their files change.
+//
+// Every setting has an environment variable, read from the environment and
+// the .env file, and a key in the optional YAML file. The environment wins
+// over the .env file, which wins over the YAML file and then the defaults.
+// Durations are given in the unit of the setting (seconds or minutes) or as a
+// Go duration such as "90s".
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Config holds every Watchdog setting
+type Config struct {
+	Panel     Panel     `yaml:"panel"`
+	API       API       `yaml:"api"`
+	Limits    Limits    `yaml:"limits"`
+	Devices   Devices   `yaml:"devices"`
+	GeoIP     GeoIP     `yaml:"geoip"`
+	Storage   Storage   `yaml:"storage"`
+	Telegram  Telegram  `yaml:"telegram"`
+	Firewall  Firewall  `yaml:"firewall"`
+	Whitelist Whitelist `yaml:"whitelist"`
+	Logging   Logging   `yaml:"logging"`
+}
+
+// Panel is the Marzban panel Watchdog reads the logs of
+type Panel struct {
+	Address  string `env:"ADDRESS" yaml:"address" required:"true" restart:"true"`
+	Port     int    `env:"PORT_ADDRESS" yaml:"port" required:"true" min:"1" max:"65535" restart:"true"`
+	SSL      bool   `env:"SSL" yaml:"ssl" restart:"true"`
+	Username string `env:"P_USER" yaml:"username" required:"true" restart:"true"`
+	Password string `env:"P_PASS" yaml:"password" required:"true" restart:"true" secret:"true"`
+	// LogInterval is how often, in seconds, the panel sends new log lines
+	LogInterval int `env:"LOG_INTERVAL" yaml:"log_interval" default:"5" min:"1"`
+	// NodeRefresh is how often the list of nodes is fetched
+	NodeRefresh time.Duration `env:"NODE_REFRESH" yaml:"node_refresh" default:"60" unit:"s" min:"1"`
+}
+
+// URL returns the base URL of the admin API
+func (p Panel) URL() string {
+	scheme := "http"
+	if p.SSL {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, p.Address, p.Port)
+}
+
+// WebSocketURL returns the base URL of the log streams
+func (p Panel) WebSocketURL() string {
+	scheme := "ws"
+	if p.SSL {
+		scheme = "wss"
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, p.Address, p.Port)
+}
+
+// API is the Watchdog HTTP API
+type API struct {
+	Port int `env:"API_PORT" yaml:"port" default:"4000" min:"1" max:"65535" restart:"true"`
+	// Auth requires an API key or JWT on every route
+	Auth bool `env:"API_AUTH" yaml:"auth" default:"true" restart:"true"`
+	// JWTSecret signs the JWTs, they are disabled when it is empty
+	JWTSecret string `env:"API_JWT_SECRET" yaml:"jwt_secret" restart:"true" secret:"true"`
+	// TokenTTL is how long an issued JWT is valid
+	TokenTTL time.Duration `env:"API_TOKEN_TTL" yaml:"token_ttl" default:"60" unit:"m" min:"1" restart:"true"`
+	// PanelLogin lets Marzban admins log in to the API with their credentials
+	PanelLogin bool `env:"API_PANEL_LOGIN" yaml:"panel_login" restart:"true"`
+}
+
+// Limits decide when users are disabled and forgotten
+type Limits struct {
+	// MaxDevices is the number of devices a user may connect from, 0 for no limit
+	MaxDevices int `env:"MAX_ALLOW_USERS" yaml:"max_devices" required:"true" min:"0"`
+	// DeviceWindow is how long an IP counts as a device after it was last seen
+	DeviceWindow time.Duration `env:"DEVICE_WINDOW" yaml:"device_window" default:"300" unit:"s" min:"1"`
+	// BanTime is how long users over their limit are disabled without a
+	// duration in the penalty ladder, and the default length of IP bans
+	BanTime time.Duration `env:"BAN_TIME" yaml:"ban_time" default:"5" unit:"m" min:"1"`
+	// PenaltyLadder is a comma-separated list of the penalties of each strike,
+	// see Ladder
+	PenaltyLadder string `env:"PENALTY_LADDER" yaml:"penalty_ladder"`
+	// StrikeDecay is how long a user must stay within the limit to lose a strike
+	StrikeDecay time.Duration `env:"STRIKE_DECAY" yaml:"strike_decay" default:"1440" unit:"m" min:"1"`
+	// UserDeleteDelay is how long a user without active IPs is kept
+	UserDeleteDelay time.Duration `env:"USER_DELETE_DELAY" yaml:"user_delete_delay" default:"10" unit:"s" min:"0"`
+	// SleepDuration is the time between two sweeps over the users
+	SleepDuration time.Duration `env:"SLEEP_DURATION" yaml:"sleep_duration" default:"5" unit:"s" min:"1"`
+}
+
+// Devices decides which IPs of a user count as one device
+type Devices struct {
+	// IPv4Prefix and IPv6Prefix group the addresses of a subnet, the full
+	// length counts every address
+	IPv4Prefix int `env:"DEVICE_IPV4_PREFIX" yaml:"ipv4_prefix" default:"32" min:"8" max:"32"`
+	IPv6Prefix int `env:"DEVICE_IPV6_PREFIX" yaml:"ipv6_prefix" default:"128" min:"16" max:"128"`
+	// ASNDatabase is the path of a MaxMind or DB-IP ASN database
+	ASNDatabase string `env:"ASN_DATABASE" yaml:"asn_database" restart:"true"`
+	// GroupByASN groups all addresses of an autonomous system
+	GroupByASN bool `env:"DEVICE_GROUP_ASN" yaml:"group_by_asn"`
+}
+
+// GeoIP locates the IPs of users
+type GeoIP struct {
+	// Database is the path of a MaxMind or DB-IP city or country database
+	Database string `env:"GEOIP_DATABASE" yaml:"database" restart:"true"`
+}
+
+// Storage selects and configures the storage backend
+type Storage struct {
+	Type string `env:"STORAGE_TYPE" yaml:"type" required:"true" oneof:"json redis sqlite postgres mysql" restart:"true"`
+
+	RedisAddr     string `env:"REDIS_ADDR" yaml:"redis_addr" default:"redis:6379" restart:"true"`
+	RedisPassword string `env:"REDIS_PASSWORD" yaml:"redis_password" restart:"true" secret:"true"`
+	RedisDB       int    `env:"REDIS_DB" yaml:"redis_db" default:"0" min:"0" restart:"true"`
+	// Expiration is the TTL of users in Redis, 0 for none
+	Expiration time.Duration `env:"EXPIRATION_TIME" yaml:"expiration" default:"0" unit:"s" min:"0" restart:"true"`
+
+	SQLitePath string `env:"SQLITE_PATH" yaml:"sqlite_path" default:"storage/watchdog.db" restart:"true"`
+
+	DSN             string        `env:"DATABASE_DSN" yaml:"dsn" restart:"true" secret:"true"`
+	MaxOpenConns    int           `env:"DB_MAX_OPEN_CONNS" yaml:"max_open_conns" default:"0" min:"0" restart:"true"`
+	MaxIdleConns    int           `env:"DB_MAX_IDLE_CONNS" yaml:"max_idle_conns" default:"0" min:"0" restart:"true"`
+	ConnMaxLifetime time.Duration `env:"DB_CONN_MAX_LIFETIME" yaml:"conn_max_lifetime" default:"0" unit:"s" min:"0" restart:"true"`
+}
+
+// Telegram configures the admin notifications
+type Telegram struct {
+	Enable   bool          `env:"TG_ENABLE" yaml:"enable"`
+	Token    string        `env:"TG_TOKEN" yaml:"token" secret:"true"`
+	Admin    string        `env:"TG_ADMIN" yaml:"admin"`
+	APIURL   string        `env:"TG_API_URL" yaml:"api_url" default:"https://api.telegram.org"`
+	Interval time.Duration `env:"TG_INTERVAL" yaml:"interval" default:"1" unit:"s" min:"0"`
+	Retries  int           `env:"TG_RETRIES" yaml:"retries" default:"3" min:"0"`
+}
+
+// Firewall selects how blocked IPs are dropped
+type Firewall struct {
+	Backend string `env:"FIREWALL_BACKEND" yaml:"backend" default:"none" oneof:"none iptables nftables ipset" restart:"true"`
+	DryRun  bool   `env:"FIREWALL_DRY_RUN" yaml:"dry_run" restart:"true"`
+}
+
+// Whitelist lists the addresses that are never counted or blocked
+type Whitelist struct {
+	// Addresses is a comma-separated list of IPs, CIDRs and domains
+	Addresses string        `env:"WHITELIST_ADDRESSES" yaml:"addresses"`
+	Refresh   time.Duration `env:"WHITELIST_REFRESH" yaml:"refresh" default:"300" unit:"s" min:"1"`
+}
+
+// Logging configures the log output
+type Logging struct {
+	// Level can be changed at runtime
+	Level  string `env:"LOG_LEVEL" yaml:"level" default:"info" oneof:"debug info warn error"`
+	Format string `env:"LOG_FORMAT" yaml:"format" default:"text" oneof:"text json" restart:"true"`
+	// Output is "stdout", "stderr" or a file path
+	Output string `env:"LOG_OUTPUT" yaml:"output" default:"stdout" restart:"true"`
+}
+
+// Load reads the settings from the environment, envFile and yamlFile, in
+// that order of precedence. A missing envFile is ignored, yamlFile is skipped
+// when empty. Every invalid setting is reported in the returned error. Load
+// can be called again to reload the files.
+func Load(envFile, yamlFile string) (*Config, error) {
+	envValues, err := godotenv.Read(envFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read %s: %w", envFile, err)
+	}
+
+	yamlValues := map[string]string{}
+	if yamlFile != "" {
+		var err error
+		if yamlValues, err = readYAML(yamlFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var cfg Config
+	errs := fill(&cfg, envValues, yamlValues)
+	errs = append(errs, cfg.validate()...)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return &cfg, nil
+}
+
+// validate checks the settings that depend on each other
+func (c *Config) validate() []error {
+	var errs []error
+	if c.Telegram.Enable {
+		if c.Telegram.Token == "" {
+			errs = append(errs, errors.New("TG_TOKEN is required when TG_ENABLE is true"))
+		}
+		if c.Telegram.Admin == "" {
+			errs = append(errs, errors.New("TG_ADMIN is required when TG_ENABLE is true"))
+		}
+	}
+	if c.Devices.GroupByASN && c.Devices.ASNDatabase == "" {
+		errs = append(errs, errors.New("ASN_DATABASE is required when DEVICE_GROUP_ASN is true"))
+	}
+	if _, err := c.Limits.Ladder(); err != nil {
+		errs = append(errs, fmt.Errorf("PENALTY_LADDER: %w", err))
+	}
+	if c.API.JWTSecret != "" && len(c.API.JWTSecret) < 32 {
+		errs = append(errs, errors.New("API_JWT_SECRET must be at least 32 characters long"))
+	}
+	if c.API.PanelLogin && c.API.JWTSecret == "" {
+		errs = append(errs, errors.New("API_JWT_SECRET is required when API_PANEL_LOGIN is true"))
+	}
+	if (c.Storage.Type == "postgres" || c.Storage.Type == "mysql") && c.Storage.DSN == "" {
+		errs = append(errs, fmt.Errorf("DATABASE_DSN is required when STORAGE_TYPE is %s", c.Storage.Type))
+	}
+	return errs
+}
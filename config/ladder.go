@@ -0,0 +1,75 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Penalty actions
+const (
+	// PenaltyWarn only notifies the admin
+	PenaltyWarn = "warn"
+	// PenaltyDisable disables the user in Marzban for the penalty's duration
+	PenaltyDisable = "disable"
+	// PenaltyRevoke revokes the user's subscription in Marzban
+	PenaltyRevoke = "revoke"
+)
+
+// Penalty is one step of the penalty ladder
+type Penalty struct {
+	Action string
+	// Duration is how long PenaltyDisable lasts
+	Duration time.Duration
+}
+
+func (p Penalty) String() string {
+	if p.Action == PenaltyDisable {
+		return fmt.Sprintf("%s:%s", p.Action, p.Duration)
+	}
+	return p.Action
+}
+
+// Ladder returns the penalties of the first, second and later strikes.
+// Strikes beyond the last step get the last penalty again. Without a
+// PENALTY_LADDER every strike disables the user for BAN_TIME.
+func (l Limits) Ladder() ([]Penalty, error) {
+	if strings.TrimSpace(l.PenaltyLadder) == "" {
+		return []Penalty{{Action: PenaltyDisable, Duration: l.BanTime}}, nil
+	}
+
+	var ladder []Penalty
+	for _, step := range strings.Split(l.PenaltyLadder, ",") {
+		p, err := ParsePenalty(step, l.BanTime)
+		if err != nil {
+			return nil, err
+		}
+		ladder = append(ladder, p)
+	}
+	return ladder, nil
+}
+
+// ParsePenalty parses one step of the ladder, as written by Penalty.String.
+// A disable without a duration lasts banTime.
+func ParsePenalty(step string, banTime time.Duration) (Penalty, error) {
+	action, duration, hasDuration := strings.Cut(strings.TrimSpace(step), ":")
+	switch action {
+	case PenaltyWarn, PenaltyRevoke:
+		if hasDuration {
+			return Penalty{}, fmt.Errorf("invalid penalty %q, %s takes no duration", step, action)
+		}
+		return Penalty{Action: action}, nil
+	case PenaltyDisable:
+		p := Penalty{Action: action, Duration: banTime}
+		if hasDuration {
+			d, err := parseDuration(duration, time.Minute)
+			if err != nil || d <= 0 {
+				return Penalty{}, fmt.Errorf("invalid penalty %q, the duration must be positive", step)
+			}
+			p.Duration = d
+		}
+		return p, nil
+	default:
+		return Penalty{}, fmt.Errorf("invalid penalty %q, must be warn, disable[:duration] or revoke", step)
+	}
+}
@@ -0,0 +1,180 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Struct tags understood by fill:
+//
+//	env       environment variable of the setting
+//	yaml      key in the YAML file, nested under the keys of its sections
+//	default   value used when the setting is not set anywhere
+//	required  "true" when the setting has no default and must be set
+//	unit      "s" or "m", the unit of a duration given as a bare number
+//	min, max  inclusive range of an int, or of a duration in its unit
+//	oneof     space-separated list of the allowed values of a string
+//	restart   "true" when a change only applies after a restart
+//	secret    "true" when the value must not be logged
+
+// readYAML reads yamlFile into a map from dotted key paths, such as
+// "panel.address", to values. Lists are joined with commas.
+func readYAML(yamlFile string) (map[string]string, error) {
+	data, err := os.ReadFile(yamlFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", yamlFile, err)
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", yamlFile, err)
+	}
+
+	values := make(map[string]string)
+	flatten("", doc, values)
+	return values, nil
+}
+
+func flatten(prefix string, node map[string]interface{}, values map[string]string) {
+	for key, value := range node {
+		path := prefix + key
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flatten(path+".", v, values)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[path] = strings.Join(items, ",")
+		case nil:
+		default:
+			values[path] = fmt.Sprint(v)
+		}
+	}
+}
+
+// fill sets every field of cfg from the environment, envValues, yamlValues
+// or its default and returns an error for each invalid one
+func fill(cfg *Config, envValues, yamlValues map[string]string) []error {
+	return fillStruct(reflect.ValueOf(cfg).Elem(), "", envValues, yamlValues)
+}
+
+func fillStruct(v reflect.Value, prefix string, envValues, yamlValues map[string]string) []error {
+	var errs []error
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		path := prefix + field.Tag.Get("yaml")
+		if field.Type.Kind() == reflect.Struct {
+			errs = append(errs, fillStruct(v.Field(i), path+".", envValues, yamlValues)...)
+			continue
+		}
+
+		name := field.Tag.Get("env")
+		raw, ok := os.LookupEnv(name)
+		if !ok || raw == "" {
+			raw, ok = envValues[name]
+		}
+		if !ok || raw == "" {
+			raw, ok = yamlValues[path]
+		}
+		if !ok || raw == "" {
+			if field.Tag.Get("required") == "true" {
+				errs = append(errs, fmt.Errorf("%s is required", name))
+				continue
+			}
+			raw = field.Tag.Get("default")
+		}
+		if err := setField(v.Field(i), field.Tag, strings.TrimSpace(raw)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errs
+}
+
+// setField parses raw into the field and checks its range
+func setField(field reflect.Value, tag reflect.StructTag, raw string) error {
+	switch field.Interface().(type) {
+	case string:
+		if oneof := tag.Get("oneof"); oneof != "" && !contains(strings.Fields(oneof), raw) {
+			return fmt.Errorf("invalid value %q, must be one of %s", raw, strings.ReplaceAll(oneof, " ", ", "))
+		}
+		field.SetString(raw)
+	case bool:
+		if raw == "" {
+			field.SetBool(false)
+			return nil
+		}
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		field.SetBool(b)
+	case int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", raw)
+		}
+		if err := checkRange(tag, int64(n), raw); err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case time.Duration:
+		unit := time.Second
+		if tag.Get("unit") == "m" {
+			unit = time.Minute
+		}
+		d, err := parseDuration(raw, unit)
+		if err != nil {
+			return err
+		}
+		if err := checkRange(tag, int64(d/unit), raw); err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+// parseDuration parses a bare number of units or a Go duration
+func parseDuration(raw string, unit time.Duration) (time.Duration, error) {
+	if n, err := strconv.Atoi(raw); err == nil {
+		return time.Duration(n) * unit, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", raw)
+	}
+	return d, nil
+}
+
+func checkRange(tag reflect.StructTag, n int64, raw string) error {
+	if min := tag.Get("min"); min != "" {
+		if limit, _ := strconv.ParseInt(min, 10, 64); n < limit {
+			return fmt.Errorf("%s is below the minimum of %s", raw, min)
+		}
+	}
+	if max := tag.Get("max"); max != "" {
+		if limit, _ := strconv.ParseInt(max, 10, 64); n > limit {
+			return fmt.Errorf("%s is above the maximum of %s", raw, max)
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
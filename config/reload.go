@@ -0,0 +1,187 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+	"watchdog/logging"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// debounce groups the bursts of events editors cause when saving a file
+const debounce = 500 * time.Millisecond
+
+// Change is a setting that differs between two configurations
+type Change struct {
+	Name     string
+	Old, New string
+	// Restart is true when the change only applies after a restart
+	Restart bool
+}
+
+func (c Change) String() string {
+	s := fmt.Sprintf("%s: %s -> %s", c.Name, c.Old, c.New)
+	if c.Restart {
+		s += " (restart required)"
+	}
+	return s
+}
+
+// Diff lists the settings that differ between old and new. Secret values
+// are not shown.
+func Diff(old, new *Config) []Change {
+	var changes []Change
+	walk(reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem(), func(field reflect.StructField, o, n reflect.Value) {
+		if o.Interface() == n.Interface() {
+			return
+		}
+		change := Change{
+			Name:    field.Tag.Get("env"),
+			Old:     fmt.Sprint(o.Interface()),
+			New:     fmt.Sprint(n.Interface()),
+			Restart: field.Tag.Get("restart") == "true",
+		}
+		if field.Tag.Get("secret") == "true" {
+			change.Old, change.New = logging.Redacted, logging.Redacted
+		}
+		changes = append(changes, change)
+	})
+	return changes
+}
+
+// keepRestartSettings copies the settings that need a restart from old to
+// new, so that new describes what is actually running
+func keepRestartSettings(old, new *Config) {
+	walk(reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem(), func(field reflect.StructField, o, n reflect.Value) {
+		if field.Tag.Get("restart") == "true" {
+			n.Set(o)
+		}
+	})
+}
+
+// walk calls fn with every setting of the two configurations
+func walk(a, b reflect.Value, fn func(field reflect.StructField, a, b reflect.Value)) {
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Type.Kind() == reflect.Struct {
+			walk(a.Field(i), b.Field(i), fn)
+			continue
+		}
+		fn(t.Field(i), a.Field(i), b.Field(i))
+	}
+}
+
+// Watcher reloads the configuration when the .env or YAML file changes and
+// on SIGHUP. An invalid configuration is logged and ignored, the running one
+// stays in place.
+type Watcher struct {
+	envFile  string
+	yamlFile string
+	// apply is called with the running and the new configuration
+	apply func(old, new *Config)
+
+	mu      sync.Mutex
+	current *Config
+}
+
+// NewWatcher returns a Watcher for the files current was loaded from. apply
+// is called after every reload that changed a setting; settings that need a
+// restart keep their running value in the configuration it receives.
+func NewWatcher(envFile, yamlFile string, current *Config, apply func(old, new *Config)) *Watcher {
+	return &Watcher{
+		envFile:  envFile,
+		yamlFile: yamlFile,
+		apply:    apply,
+		current:  current,
+	}
+}
+
+// Run watches the files and SIGHUP until ctx is done
+func (w *Watcher) Run(ctx context.Context) error {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch configuration files: %w", err)
+	}
+	defer fsw.Close()
+
+	// Watch the directories, editors and Kubernetes replace files instead of
+	// writing them
+	files := make(map[string]bool)
+	for _, file := range []string{w.envFile, w.yamlFile} {
+		if file == "" {
+			continue
+		}
+		path, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		files[path] = true
+		if err := fsw.Add(filepath.Dir(path)); err != nil {
+			return fmt.Errorf("failed to watch %s: %w", filepath.Dir(path), err)
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			slog.Info("Received SIGHUP, reloading configuration")
+			w.Reload()
+		case event, ok := <-fsw.Events:
+			if !ok {
+				return nil
+			}
+			if path, _ := filepath.Abs(event.Name); files[path] {
+				timer = time.After(debounce)
+			}
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Error("Error watching configuration files", logging.KeyError, err)
+		case <-timer:
+			timer = nil
+			slog.Info("Configuration file changed, reloading")
+			w.Reload()
+		}
+	}
+}
+
+// Reload loads the configuration again and applies the changes
+func (w *Watcher) Reload() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	next, err := Load(w.envFile, w.yamlFile)
+	if err != nil {
+		slog.Error("Keeping the running configuration", logging.KeyError, err)
+		return
+	}
+
+	changes := Diff(w.current, next)
+	if len(changes) == 0 {
+		slog.Info("Configuration unchanged")
+		return
+	}
+	for _, change := range changes {
+		slog.Info("Configuration changed", "setting", change.Name, "old", change.Old, "new", change.New, "restart_required", change.Restart)
+	}
+
+	keepRestartSettings(w.current, next)
+	w.apply(w.current, next)
+	w.current = next
+}
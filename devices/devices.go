@@ -0,0 +1,57 @@
+// Package devices decides which IPs of a user count as the same device.
+//
+// Mobile users behind carrier-grade NAT hop between many addresses of the
+// same subnet, or of the same autonomous system, within minutes. Grouping
+// those addresses keeps one phone from counting as many devices.
+package devices
+
+import (
+	"net/netip"
+	"strconv"
+)
+
+// ASNLookup finds the autonomous system of an address
+type ASNLookup interface {
+	Lookup(addr netip.Addr) (number uint, organization string, ok bool)
+}
+
+// Grouper maps IPs to device keys, IPs with the same key count as one
+// device. The zero Grouper counts every IP as its own device.
+type Grouper struct {
+	// IPv4Prefix and IPv6Prefix are the prefix lengths of the subnets whose
+	// addresses are grouped. 0 or the full length disables the grouping.
+	IPv4Prefix int
+	IPv6Prefix int
+	// ASN, when not nil, groups all addresses of an autonomous system. IPs
+	// without an entry in the database fall back to the subnets.
+	ASN ASNLookup
+}
+
+// Key returns the device key of ip, e.g. "AS13335", "203.0.113.0/24" or the
+// IP itself when it is not grouped
+func (g Grouper) Key(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+
+	if g.ASN != nil {
+		if number, _, ok := g.ASN.Lookup(addr); ok {
+			return "AS" + strconv.FormatUint(uint64(number), 10)
+		}
+	}
+
+	bits := g.IPv6Prefix
+	if addr.Is4() {
+		bits = g.IPv4Prefix
+	}
+	if bits <= 0 || bits >= addr.BitLen() {
+		return addr.String()
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return addr.String()
+	}
+	return prefix.String()
+}
@@ -0,0 +1,343 @@
+// Package enforcer acts on users that connect from more devices than their
+// limit allows, with penalties that grow with every strike.
+package enforcer
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+	"watchdog/audit"
+	"watchdog/config"
+	"watchdog/devices"
+	"watchdog/logging"
+	"watchdog/marzban"
+	"watchdog/metrics"
+	"watchdog/models"
+	"watchdog/notify"
+	"watchdog/storage"
+)
+
+// Policy decides when users are over their limit and how they are punished
+type Policy struct {
+	// Ladder holds the penalties of the first, second and later strikes
+	Ladder []config.Penalty
+	// DeviceWindow is how long an IP counts as a device after it was last seen
+	DeviceWindow time.Duration
+	// StrikeDecay is how long a user must stay within the limit to lose a strike
+	StrikeDecay time.Duration
+	// DefaultLimit is the device limit of users without their own
+	DefaultLimit int
+	// Devices decides which IPs count as one device
+	Devices devices.Grouper
+}
+
+// DeviceCount returns the number of devices the user was seen on within the
+// device window before now
+func (p Policy) DeviceCount(user *models.User, now time.Time) int {
+	return user.DeviceCount(now.Add(-p.DeviceWindow), p.Devices.Key)
+}
+
+// Enforcer gives users over their device limit a strike and the penalty of
+// that strike on the ladder, and re-enables disabled users once their ban
+// has passed. Its state lives in storage, so strikes and pending re-enables
+// survive restarts.
+type Enforcer struct {
+	store    storage.Store
+	panel    *marzban.Client
+	notifier notify.Notifier
+	audit    *audit.Log
+	// now is the clock of the sweeps
+	now func() time.Time
+
+	mu     sync.Mutex
+	policy Policy
+	// retries holds the backoff of users whose penalty is pending
+	retries map[string]retryState
+}
+
+// Backoff of pending penalties: the delay doubles after every failed attempt
+// up to maxRetry
+const (
+	minRetry = 30 * time.Second
+	maxRetry = 30 * time.Minute
+)
+
+// retryState is when to try a user's pending penalty again
+type retryState struct {
+	next  time.Time
+	delay time.Duration
+}
+
+// New returns an Enforcer that applies policy and records its actions in
+// auditLog
+func New(store storage.Store, panel *marzban.Client, notifier notify.Notifier, auditLog *audit.Log, policy Policy) *Enforcer {
+	return &Enforcer{
+		store:    store,
+		panel:    panel,
+		notifier: notifier,
+		audit:    auditLog,
+		now:      time.Now,
+		policy:   policy,
+		retries:  make(map[string]retryState),
+	}
+}
+
+// SetPolicy changes the policy of the next sweeps. Users already disabled
+// keep their ban.
+func (e *Enforcer) SetPolicy(policy Policy) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.policy = policy
+}
+
+// Policy returns the current policy
+func (e *Enforcer) Policy() Policy {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.policy
+}
+
+// Sweep re-enables users whose ban has expired, takes strikes away from
+// users that stayed within their limit and punishes users over their limit.
+// It is meant to be called periodically.
+func (e *Enforcer) Sweep() {
+	users, err := e.store.ListUsers()
+	if err != nil {
+		slog.Error("Enforcer: error retrieving users", logging.KeyError, err)
+		return
+	}
+
+	e.mu.Lock()
+	policy := e.policy
+	e.mu.Unlock()
+
+	now := e.now()
+	for i := range users {
+		user := &users[i]
+		if user.Disabled() {
+			if !now.Before(*user.DisabledUntil) {
+				e.enable(user, now)
+			}
+			continue
+		}
+		if last := user.LastStrike(); last != nil && last.Pending {
+			e.retry(user, *last, now)
+			continue
+		}
+		e.decay(user, now, policy.StrikeDecay)
+
+		limit := user.DeviceLimit(policy.DefaultLimit)
+		count := policy.DeviceCount(user, now)
+		if limit <= 0 || count <= limit {
+			continue
+		}
+		// The devices that earned the last strike count for a whole device
+		// window, give the user that long to disconnect them
+		if last := user.LastStrike(); last != nil && now.Sub(last.Time) < policy.DeviceWindow {
+			continue
+		}
+		e.strike(user, fmt.Sprintf("connected from %d devices, limit is %d", count, limit), now, policy.Ladder)
+	}
+}
+
+// decay takes a strike away for every clean period the user stayed within
+// the limit
+func (e *Enforcer) decay(user *models.User, now time.Time, period time.Duration) {
+	if user.Strikes == 0 || user.CleanSince == nil || now.Sub(*user.CleanSince) < period {
+		return
+	}
+
+	err := e.store.UpdateUser(user.Email, func(u *models.User) error {
+		if u.Strikes == 0 || u.CleanSince == nil {
+			return nil
+		}
+		periods := int(now.Sub(*u.CleanSince) / period)
+		u.Strikes = max(u.Strikes-periods, 0)
+		if u.Strikes == 0 {
+			u.CleanSince = nil
+		} else {
+			cleanSince := u.CleanSince.Add(time.Duration(periods) * period)
+			u.CleanSince = &cleanSince
+		}
+		user.Strikes, user.CleanSince = u.Strikes, u.CleanSince
+		return nil
+	})
+	if err != nil {
+		slog.Error("Enforcer: failed to decay strikes", logging.KeyUser, user.Email, logging.KeyError, err)
+		return
+	}
+	slog.Info("Enforcer: strikes decayed", logging.KeyUser, marzban.Username(user.Email), "strikes", user.Strikes)
+}
+
+// strike gives the user another strike and applies its penalty. A penalty
+// Marzban fails to apply leaves the strike pending, it is retried by later
+// sweeps without striking again.
+func (e *Enforcer) strike(user *models.User, reason string, now time.Time, ladder []config.Penalty) {
+	username := marzban.Username(user.Email)
+	level := user.Strikes + 1
+	penalty := ladder[min(level, len(ladder))-1]
+	metrics.Violations.Inc()
+	notify.Notifyf(e.notifier, notify.LimitViolation, "%s %s\nStrike %d, penalty: %s", username, reason, level, penalty)
+
+	strike := models.Strike{Time: now, Level: level, Penalty: penalty.String(), Reason: reason}
+	until, applyErr := e.apply(user.Email, penalty, reason, now)
+	if applyErr != nil {
+		strike.Pending = true
+		strike.Error = applyErr.Error()
+		e.retryLater(user.Email, now)
+	}
+
+	err := e.store.UpdateUser(user.Email, func(u *models.User) error {
+		u.AddStrike(strike)
+		if applyErr == nil && penalty.Action == config.PenaltyDisable {
+			u.DisabledAt = &now
+			u.DisabledUntil = &until
+			u.DisabledReason = reason
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Enforcer: failed to record the strike", logging.KeyUser, username, "penalty", penalty.String(), logging.KeyError, err)
+		return
+	}
+	if applyErr != nil {
+		slog.Error("Enforcer: strike recorded, penalty pending", logging.KeyUser, username, "strikes", level, "penalty", penalty.String(), logging.KeyError, applyErr)
+		return
+	}
+	slog.Info("Enforcer: strike", logging.KeyUser, username, "strikes", level, "penalty", penalty.String(), "reason", reason)
+	e.notifyPenalty(username, penalty, until, reason)
+}
+
+// retry applies the penalty of a pending strike again, unless the user's
+// backoff has not passed yet
+func (e *Enforcer) retry(user *models.User, strike models.Strike, now time.Time) {
+	e.mu.Lock()
+	retry, ok := e.retries[user.Email]
+	e.mu.Unlock()
+	if ok && now.Before(retry.next) {
+		return
+	}
+
+	username := marzban.Username(user.Email)
+	penalty, err := config.ParsePenalty(strike.Penalty, 0)
+	if err == nil {
+		var until time.Time
+		if until, err = e.apply(user.Email, penalty, strike.Reason, now); err == nil {
+			e.applied(user.Email, penalty, until, strike.Reason, now)
+			return
+		}
+	}
+	e.retryLater(user.Email, now)
+	slog.Error("Enforcer: penalty still pending", logging.KeyUser, username, "penalty", strike.Penalty, logging.KeyError, err)
+}
+
+// applied records that the penalty of the user's pending strike was applied
+func (e *Enforcer) applied(email string, penalty config.Penalty, until time.Time, reason string, now time.Time) {
+	e.mu.Lock()
+	delete(e.retries, email)
+	e.mu.Unlock()
+
+	username := marzban.Username(email)
+	err := e.store.UpdateUser(email, func(u *models.User) error {
+		if last := u.LastStrike(); last != nil {
+			last.Pending = false
+			last.Error = ""
+		}
+		if penalty.Action == config.PenaltyDisable {
+			u.DisabledAt = &now
+			u.DisabledUntil = &until
+			u.DisabledReason = reason
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Enforcer: applied penalty but failed to record it", logging.KeyUser, username, "penalty", penalty.String(), logging.KeyError, err)
+		return
+	}
+	slog.Info("Enforcer: applied pending penalty", logging.KeyUser, username, "penalty", penalty.String())
+	e.notifyPenalty(username, penalty, until, reason)
+}
+
+// retryLater backs off the next attempt to apply the user's pending penalty
+func (e *Enforcer) retryLater(email string, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delay := minRetry
+	if retry, ok := e.retries[email]; ok {
+		delay = min(retry.delay*2, maxRetry)
+	}
+	e.retries[email] = retryState{next: now.Add(delay), delay: delay}
+}
+
+// apply carries out penalty in Marzban and records it in the audit log. It
+// returns when a disable ends.
+func (e *Enforcer) apply(email string, penalty config.Penalty, reason string, now time.Time) (time.Time, error) {
+	username := marzban.Username(email)
+	switch penalty.Action {
+	case config.PenaltyWarn:
+		e.audit.Record(audit.ActorWatchdog, audit.UserWarn, email, reason, nil)
+	case config.PenaltyDisable:
+		until := now.Add(penalty.Duration)
+		err := e.panel.SetUserStatus(username, marzban.StatusDisabled)
+		e.audit.Record(audit.ActorWatchdog, audit.UserDisable, email, fmt.Sprintf("%s, until %s", reason, until.Format(time.RFC3339)), err)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to disable user: %w", err)
+		}
+		metrics.Disables.Inc()
+		return until, nil
+	case config.PenaltyRevoke:
+		err := e.panel.RevokeSubscription(username)
+		e.audit.Record(audit.ActorWatchdog, audit.UserRevoke, email, reason, err)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to revoke subscription: %w", err)
+		}
+		metrics.Revocations.Inc()
+	}
+	return time.Time{}, nil
+}
+
+// notifyPenalty tells the admin about an applied disable or revocation
+func (e *Enforcer) notifyPenalty(username string, penalty config.Penalty, until time.Time, reason string) {
+	switch penalty.Action {
+	case config.PenaltyDisable:
+		notify.Notifyf(e.notifier, notify.UserDisabled, "%s is disabled until %s\nReason: %s", username, until.Format(time.RFC3339), reason)
+	case config.PenaltyRevoke:
+		notify.Notifyf(e.notifier, notify.SubRevoked, "The subscription of %s was revoked\nReason: %s", username, reason)
+	}
+}
+
+// enable turns the user back on in Marzban and clears the recorded ban. The
+// clean period of the user's strikes starts over.
+func (e *Enforcer) enable(user *models.User, now time.Time) {
+	username := marzban.Username(user.Email)
+	err := e.panel.SetUserStatus(username, marzban.StatusActive)
+	e.audit.Record(audit.ActorWatchdog, audit.UserEnable, user.Email, "ban ended", err)
+	if err != nil {
+		slog.Error("Enforcer: failed to re-enable user", logging.KeyUser, username, logging.KeyError, err)
+		return
+	}
+
+	// A disabled user sends no traffic, so the IPs it had are stale. Forget
+	// them first, otherwise the user would be disabled again right away.
+	if err := e.store.ClearIPs(user.Email); err != nil {
+		slog.Error("Enforcer: re-enabled user but failed to clear its IPs", logging.KeyUser, username, logging.KeyError, err)
+		return
+	}
+	err = e.store.UpdateUser(user.Email, func(u *models.User) error {
+		u.DisabledAt = nil
+		u.DisabledUntil = nil
+		u.DisabledReason = ""
+		if u.Strikes > 0 {
+			u.CleanSince = &now
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Enforcer: re-enabled user but failed to record it", logging.KeyUser, username, logging.KeyError, err)
+		return
+	}
+	slog.Info("Enforcer: re-enabled user", logging.KeyUser, username)
+	notify.Notifyf(e.notifier, notify.UserEnabled, "%s is active again", username)
+}
@@ -0,0 +1,320 @@
+package enforcer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"watchdog/audit"
+	"watchdog/config"
+	"watchdog/marzban"
+	"watchdog/models"
+	"watchdog/notify"
+	"watchdog/storage"
+	"watchdog/storage/storagetest"
+)
+
+// fakePanel is a Marzban admin API that records the status of every user and
+// the revoked subscriptions
+type fakePanel struct {
+	mu       sync.Mutex
+	statuses map[string]string
+	revoked  []string
+	updates  int
+	// fail makes every user update fail
+	fail bool
+}
+
+func (p *fakePanel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && r.URL.Path == "/api/admin/token" {
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "token"})
+		return
+	}
+	username, ok := strings.CutPrefix(r.URL.Path, "/api/user/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if username, ok := strings.CutSuffix(username, "/revoke_sub"); ok && r.Method == http.MethodPost {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.updates++
+		p.revoked = append(p.revoked, username)
+		return
+	}
+	if r.Method != http.MethodPut {
+		http.NotFound(w, r)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.updates++
+	if p.fail {
+		http.Error(w, "database is locked", http.StatusInternalServerError)
+		return
+	}
+	var body struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	p.statuses[username] = body.Status
+}
+
+func (p *fakePanel) status(username string) (string, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.statuses[username], p.updates
+}
+
+func (p *fakePanel) setFail(fail bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fail = fail
+}
+
+func (p *fakePanel) revocations() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.revoked...)
+}
+
+// clock is the time of the sweeps, it only moves when advanced
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// testPolicy disables users over a default limit of one device for an hour
+var testPolicy = Policy{
+	Ladder:       []config.Penalty{{Action: config.PenaltyDisable, Duration: time.Hour}},
+	DeviceWindow: 5 * time.Minute,
+	StrikeDecay:  24 * time.Hour,
+	DefaultLimit: 1,
+}
+
+// newTestEnforcer returns an Enforcer that applies policy, with a fake panel
+// and a clock starting now
+func newTestEnforcer(t *testing.T, store storage.Store, policy Policy) (*Enforcer, *fakePanel, *clock) {
+	t.Helper()
+	panel := &fakePanel{statuses: make(map[string]string)}
+	server := httptest.NewServer(panel)
+	t.Cleanup(server.Close)
+
+	client := marzban.New(server.URL, marzban.NewTokenManager(server.URL, "admin", "secret", nil))
+	e := New(store, client, notify.Nop{}, audit.New(store), policy)
+	c := &clock{now: time.Now()}
+	e.now = c.Now
+	return e, panel, c
+}
+
+// connect records the IPs as active IPs of the user
+func connect(t *testing.T, store storage.Store, user models.User, ips ...string) {
+	t.Helper()
+	for _, ip := range ips {
+		if err := store.UpsertUserIP(&user, ip, nil); err != nil {
+			t.Fatalf("UpsertUserIP() error = %v", err)
+		}
+	}
+}
+
+func getUser(t *testing.T, store storage.Store, email string) *models.User {
+	t.Helper()
+	user, err := store.GetUser(email)
+	if err != nil {
+		t.Fatalf("GetUser() error = %v", err)
+	}
+	return user
+}
+
+func TestSweepDisablesAndEnables(t *testing.T) {
+	store := storagetest.NewJSONStore(t)
+	e, panel, clock := newTestEnforcer(t, store, testPolicy)
+	unlimited := 0
+	connect(t, store, models.User{Email: "12.alice"}, "1.2.3.4", "5.6.7.8")
+	connect(t, store, models.User{Email: "3.bob"}, "9.9.9.9")
+	connect(t, store, models.User{Email: "7.carol", Limit: &unlimited}, "1.1.1.1", "2.2.2.2", "3.3.3.3")
+
+	e.Sweep()
+	if status, _ := panel.status("alice"); status != marzban.StatusDisabled {
+		t.Fatalf("alice status = %q, want %q", status, marzban.StatusDisabled)
+	}
+	if status, _ := panel.status("bob"); status != "" {
+		t.Errorf("bob within the limit got status %q", status)
+	}
+	if status, _ := panel.status("carol"); status != "" {
+		t.Errorf("carol without a limit got status %q", status)
+	}
+	alice := getUser(t, store, "12.alice")
+	if !alice.Disabled() || !alice.DisabledUntil.Equal(clock.Now().Add(time.Hour)) {
+		t.Fatalf("alice disabled until %v, want an hour from now", alice.DisabledUntil)
+	}
+
+	// The ban lasts an hour
+	clock.Advance(59 * time.Minute)
+	_, updates := panel.status("alice")
+	e.Sweep()
+	if status, after := panel.status("alice"); status != marzban.StatusDisabled || after != updates {
+		t.Fatalf("alice status = %q after %d updates, want still disabled", status, after-updates)
+	}
+
+	clock.Advance(time.Minute)
+	e.Sweep()
+	if status, _ := panel.status("alice"); status != marzban.StatusActive {
+		t.Fatalf("alice status = %q, want %q", status, marzban.StatusActive)
+	}
+	alice = getUser(t, store, "12.alice")
+	if alice.Disabled() || len(alice.ActiveIPs) != 0 || alice.Strikes != 1 {
+		t.Errorf("alice disabled = %v, IPs = %v, strikes = %d, want enabled without IPs and 1 strike", alice.Disabled(), alice.ActiveIPs, alice.Strikes)
+	}
+
+	entries, err := store.ListAudit(storage.AuditFilter{Target: "12.alice"})
+	if err != nil {
+		t.Fatalf("ListAudit() error = %v", err)
+	}
+	if len(entries) != 2 || entries[0].Action != audit.UserEnable || entries[1].Action != audit.UserDisable {
+		t.Errorf("audit entries = %+v, want a disable and an enable", entries)
+	}
+}
+
+func TestSweepLadder(t *testing.T) {
+	store := storagetest.NewJSONStore(t)
+	policy := testPolicy
+	policy.Ladder = []config.Penalty{
+		{Action: config.PenaltyWarn},
+		{Action: config.PenaltyDisable, Duration: 10 * time.Minute},
+		{Action: config.PenaltyRevoke},
+	}
+	e, panel, clock := newTestEnforcer(t, store, policy)
+	connect(t, store, models.User{Email: "12.alice"}, "1.2.3.4", "5.6.7.8")
+
+	// The first strike only warns
+	e.Sweep()
+	alice := getUser(t, store, "12.alice")
+	if status, updates := panel.status("alice"); alice.Strikes != 1 || alice.Disabled() || updates != 0 {
+		t.Fatalf("strikes = %d, disabled = %v, status = %q, want a warning only", alice.Strikes, alice.Disabled(), status)
+	}
+
+	// The devices get a device window to disconnect
+	e.Sweep()
+	if alice = getUser(t, store, "12.alice"); alice.Strikes != 1 {
+		t.Fatalf("strikes = %d within the device window, want 1", alice.Strikes)
+	}
+
+	// The IPs were seen right after the clock started, so they still count
+	clock.Advance(policy.DeviceWindow)
+	e.Sweep()
+	alice = getUser(t, store, "12.alice")
+	if status, _ := panel.status("alice"); alice.Strikes != 2 || status != marzban.StatusDisabled {
+		t.Fatalf("strikes = %d, status = %q, want the second strike to disable", alice.Strikes, status)
+	}
+	if !alice.DisabledUntil.Equal(clock.Now().Add(10 * time.Minute)) {
+		t.Errorf("disabled until %v, want 10 minutes from now", alice.DisabledUntil)
+	}
+	if last := alice.LastStrike(); last == nil || last.Level != 2 || last.Penalty != policy.Ladder[1].String() {
+		t.Errorf("last strike = %+v, want level 2 with the second penalty", last)
+	}
+
+	clock.Advance(10 * time.Minute)
+	e.Sweep()
+	if status, _ := panel.status("alice"); status != marzban.StatusActive {
+		t.Fatalf("status = %q, want re-enabled", status)
+	}
+
+	// A day within the limit takes one strike away
+	clock.Advance(policy.StrikeDecay)
+	e.Sweep()
+	if alice = getUser(t, store, "12.alice"); alice.Strikes != 1 || len(alice.StrikeHistory) != 2 {
+		t.Errorf("strikes = %d, history = %d, want 1 strike and the history kept", alice.Strikes, len(alice.StrikeHistory))
+	}
+	if revoked := panel.revocations(); len(revoked) != 0 {
+		t.Errorf("revoked = %v, want none", revoked)
+	}
+}
+
+func TestSweepRevokes(t *testing.T) {
+	store := storagetest.NewJSONStore(t)
+	policy := testPolicy
+	policy.Ladder = []config.Penalty{{Action: config.PenaltyRevoke}}
+	e, panel, _ := newTestEnforcer(t, store, policy)
+	connect(t, store, models.User{Email: "12.alice"}, "1.2.3.4", "5.6.7.8")
+
+	e.Sweep()
+	if revoked := panel.revocations(); len(revoked) != 1 || revoked[0] != "alice" {
+		t.Fatalf("revoked = %v, want alice", revoked)
+	}
+	if alice := getUser(t, store, "12.alice"); alice.Disabled() || alice.Strikes != 1 {
+		t.Errorf("disabled = %v, strikes = %d, want 1 strike without a ban", alice.Disabled(), alice.Strikes)
+	}
+}
+
+func TestSweepRetriesPendingPenalty(t *testing.T) {
+	store := storagetest.NewJSONStore(t)
+	e, panel, clock := newTestEnforcer(t, store, testPolicy)
+	connect(t, store, models.User{Email: "12.alice"}, "1.2.3.4", "5.6.7.8")
+	panel.setFail(true)
+
+	e.Sweep()
+	alice := getUser(t, store, "12.alice")
+	last := alice.LastStrike()
+	if alice.Disabled() || alice.Strikes != 1 || last == nil || !last.Pending || last.Error == "" {
+		t.Fatalf("disabled = %v, strikes = %d, last strike = %+v, want 1 pending strike", alice.Disabled(), alice.Strikes, last)
+	}
+
+	// Within the backoff nothing is sent and no strike is added
+	_, updates := panel.status("alice")
+	clock.Advance(minRetry - time.Second)
+	e.Sweep()
+	if _, after := panel.status("alice"); after != updates {
+		t.Errorf("panel updates = %d during the backoff, want none", after-updates)
+	}
+	if alice = getUser(t, store, "12.alice"); alice.Strikes != 1 {
+		t.Errorf("strikes = %d during the backoff, want 1", alice.Strikes)
+	}
+
+	// A failed retry doubles the backoff
+	clock.Advance(time.Second)
+	e.Sweep()
+	if _, after := panel.status("alice"); after == updates {
+		t.Fatal("the pending penalty was not retried after the backoff")
+	}
+	_, updates = panel.status("alice")
+	clock.Advance(2*minRetry - time.Second)
+	e.Sweep()
+	if _, after := panel.status("alice"); after != updates {
+		t.Errorf("panel updates = %d during the doubled backoff, want none", after-updates)
+	}
+
+	panel.setFail(false)
+	clock.Advance(time.Second)
+	e.Sweep()
+	if status, _ := panel.status("alice"); status != marzban.StatusDisabled {
+		t.Fatalf("status = %q, want %q", status, marzban.StatusDisabled)
+	}
+	alice = getUser(t, store, "12.alice")
+	last = alice.LastStrike()
+	if !alice.Disabled() || alice.Strikes != 1 || last.Pending || last.Error != "" {
+		t.Errorf("disabled = %v, strikes = %d, last strike = %+v, want disabled with 1 applied strike", alice.Disabled(), alice.Strikes, last)
+	}
+	if !alice.DisabledUntil.Equal(clock.Now().Add(time.Hour)) {
+		t.Errorf("disabled until %v, want an hour after the penalty was applied", alice.DisabledUntil)
+	}
+}
@@ -0,0 +1,137 @@
+// Package firewall drops traffic from blocked IPs using the host firewall.
+//
+// Every backend keeps its rules in objects owned by Watchdog (a chain, a set
+// or a table), so they can be rebuilt at startup and removed on uninstall
+// without touching the rest of the ruleset.
+package firewall
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Name of the chain, sets and table created by the backends
+const (
+	ChainName = "WATCHDOG"
+	SetName   = "watchdog"
+	TableName = "watchdog"
+)
+
+// Backend blocks and unblocks IPs in the host firewall
+type Backend interface {
+	// Setup (re)creates the Watchdog chain so that it blocks exactly ips
+	Setup(ips []string) error
+	// Block drops all traffic from ip
+	Block(ip string) error
+	// Unblock removes the rule for ip
+	Unblock(ip string) error
+	// Teardown removes the Watchdog chain and everything in it
+	Teardown() error
+}
+
+// New returns the backend called name ("none", "iptables", "nftables" or
+// "ipset"). With dryRun the backend logs and records its commands instead of
+// running them.
+func New(name string, dryRun bool) (Backend, error) {
+	var run Runner = ExecRunner{}
+	if dryRun {
+		run = &Recorder{Log: true}
+	}
+	return NewWithRunner(name, run)
+}
+
+// NewWithRunner returns the backend called name, which runs its commands
+// with run
+func NewWithRunner(name string, run Runner) (Backend, error) {
+	switch name {
+	case "", "none":
+		return None{}, nil
+	case "iptables":
+		return &IPTables{run: run}, nil
+	case "nftables":
+		return &NFTables{run: run}, nil
+	case "ipset":
+		return &IPSet{run: run}, nil
+	default:
+		return nil, fmt.Errorf("invalid FIREWALL_BACKEND %q, must be 'none', 'iptables', 'nftables' or 'ipset'", name)
+	}
+}
+
+// Runner runs firewall commands
+type Runner interface {
+	// Run runs name with args, feeding it stdin when stdin is not empty
+	Run(stdin string, name string, args ...string) error
+}
+
+// ExecRunner runs commands on the host
+type ExecRunner struct{}
+
+// Run runs the command and includes its output in the returned error
+func (ExecRunner) Run(stdin string, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Recorder records commands instead of running them. Every command succeeds.
+type Recorder struct {
+	// Log also prints every command
+	Log bool
+
+	mu       sync.Mutex
+	commands []string
+}
+
+// Run records the command
+func (r *Recorder) Run(stdin string, name string, args ...string) error {
+	command := strings.Join(append([]string{name}, args...), " ")
+	if stdin != "" {
+		command += " <<EOF\n" + stdin + "EOF"
+	}
+
+	r.mu.Lock()
+	r.commands = append(r.commands, command)
+	r.mu.Unlock()
+
+	if r.Log {
+		slog.Info("Firewall (dry run)", "command", command)
+	}
+	return nil
+}
+
+// Commands returns the commands recorded so far
+func (r *Recorder) Commands() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.commands...)
+}
+
+// None is the backend used when no firewall is configured. It does nothing.
+type None struct{}
+
+func (None) Setup(ips []string) error { return nil }
+func (None) Block(ip string) error    { return nil }
+func (None) Unblock(ip string) error  { return nil }
+func (None) Teardown() error          { return nil }
+
+// family returns "4" or "6" for a valid IP address
+func family(ip string) (string, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", fmt.Errorf("invalid IP address %q", ip)
+	}
+	if parsed.To4() != nil {
+		return "4", nil
+	}
+	return "6", nil
+}
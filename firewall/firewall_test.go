@@ -0,0 +1,152 @@
+package firewall
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBackendCommands(t *testing.T) {
+	tests := []struct {
+		backend  string
+		setup    []string
+		block    []string
+		unblock  []string
+		teardown []string
+	}{
+		{
+			backend: "iptables",
+			setup: []string{
+				"iptables -N WATCHDOG",
+				"iptables -F WATCHDOG",
+				"iptables -D INPUT -j WATCHDOG",
+				"iptables -I INPUT -j WATCHDOG",
+				"ip6tables -N WATCHDOG",
+				"ip6tables -F WATCHDOG",
+				"ip6tables -D INPUT -j WATCHDOG",
+				"ip6tables -I INPUT -j WATCHDOG",
+				"iptables -D WATCHDOG -s 1.2.3.4 -j DROP",
+				"iptables -A WATCHDOG -s 1.2.3.4 -j DROP",
+			},
+			block: []string{
+				"ip6tables -D WATCHDOG -s 2001:db8::1 -j DROP",
+				"ip6tables -A WATCHDOG -s 2001:db8::1 -j DROP",
+			},
+			unblock: []string{
+				"ip6tables -D WATCHDOG -s 2001:db8::1 -j DROP",
+			},
+			teardown: []string{
+				"iptables -n -L WATCHDOG",
+				"iptables -D INPUT -j WATCHDOG",
+				"iptables -F WATCHDOG",
+				"iptables -X WATCHDOG",
+				"ip6tables -n -L WATCHDOG",
+				"ip6tables -D INPUT -j WATCHDOG",
+				"ip6tables -F WATCHDOG",
+				"ip6tables -X WATCHDOG",
+			},
+		},
+		{
+			backend: "nftables",
+			setup: []string{
+				"nft list table inet watchdog",
+				"nft delete table inet watchdog",
+				"nft -f - <<EOF\n" + nftRuleset + "EOF",
+				"nft add element inet watchdog blocked4 { 1.2.3.4 }",
+			},
+			block: []string{
+				"nft add element inet watchdog blocked6 { 2001:db8::1 }",
+			},
+			unblock: []string{
+				"nft delete element inet watchdog blocked6 { 2001:db8::1 }",
+			},
+			teardown: []string{
+				"nft list table inet watchdog",
+				"nft delete table inet watchdog",
+			},
+		},
+		{
+			backend: "ipset",
+			setup: []string{
+				"ipset create watchdog4 hash:ip family inet -exist",
+				"ipset flush watchdog4",
+				"iptables -N WATCHDOG",
+				"iptables -F WATCHDOG",
+				"iptables -D INPUT -j WATCHDOG",
+				"iptables -I INPUT -j WATCHDOG",
+				"iptables -A WATCHDOG -m set --match-set watchdog4 src -j DROP",
+				"ipset create watchdog6 hash:ip family inet6 -exist",
+				"ipset flush watchdog6",
+				"ip6tables -N WATCHDOG",
+				"ip6tables -F WATCHDOG",
+				"ip6tables -D INPUT -j WATCHDOG",
+				"ip6tables -I INPUT -j WATCHDOG",
+				"ip6tables -A WATCHDOG -m set --match-set watchdog6 src -j DROP",
+				"ipset add watchdog4 1.2.3.4 -exist",
+			},
+			block: []string{
+				"ipset add watchdog6 2001:db8::1 -exist",
+			},
+			unblock: []string{
+				"ipset del watchdog6 2001:db8::1 -exist",
+			},
+			teardown: []string{
+				"iptables -n -L WATCHDOG",
+				"iptables -D INPUT -j WATCHDOG",
+				"iptables -F WATCHDOG",
+				"iptables -X WATCHDOG",
+				"ipset list -n watchdog4",
+				"ipset destroy watchdog4",
+				"ip6tables -n -L WATCHDOG",
+				"ip6tables -D INPUT -j WATCHDOG",
+				"ip6tables -F WATCHDOG",
+				"ip6tables -X WATCHDOG",
+				"ipset list -n watchdog6",
+				"ipset destroy watchdog6",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.backend, func(t *testing.T) {
+			recorder := &Recorder{}
+			backend, err := NewWithRunner(tt.backend, recorder)
+			if err != nil {
+				t.Fatalf("NewWithRunner() error = %v", err)
+			}
+
+			steps := []struct {
+				name string
+				run  func() error
+				want []string
+			}{
+				{"Setup", func() error { return backend.Setup([]string{"1.2.3.4"}) }, tt.setup},
+				{"Block", func() error { return backend.Block("2001:db8::1") }, tt.block},
+				{"Unblock", func() error { return backend.Unblock("2001:db8::1") }, tt.unblock},
+				{"Teardown", backend.Teardown, tt.teardown},
+			}
+			for _, step := range steps {
+				before := len(recorder.Commands())
+				if err := step.run(); err != nil {
+					t.Fatalf("%s() error = %v", step.name, err)
+				}
+				if got := recorder.Commands()[before:]; !slices.Equal(got, step.want) {
+					t.Errorf("%s() commands:\n%s\nwant:\n%s", step.name, strings.Join(got, "\n"), strings.Join(step.want, "\n"))
+				}
+			}
+
+			if err := backend.Block("not-an-ip"); err == nil {
+				t.Error("Block() of an invalid IP succeeded")
+			}
+		})
+	}
+}
+
+func TestNewWithRunner(t *testing.T) {
+	if backend, err := NewWithRunner("none", &Recorder{}); err != nil || backend != (None{}) {
+		t.Errorf(`NewWithRunner("none") = %v, %v, want None`, backend, err)
+	}
+	if _, err := NewWithRunner("pf", &Recorder{}); err == nil {
+		t.Error(`NewWithRunner("pf") succeeded`)
+	}
+}
@@ -0,0 +1,76 @@
+package firewall
+
+// IPSet keeps blocked IPs in the ipsets watchdog4 and watchdog6 and drops
+// them with a single match-set rule per family in the WATCHDOG chain. Large
+// block lists stay fast because the kernel looks IPs up in a hash.
+type IPSet struct {
+	run Runner
+}
+
+var ipsetFamilies = map[string]string{"4": "inet", "6": "inet6"}
+
+func ipsetName(fam string) string {
+	return SetName + fam
+}
+
+// Setup recreates the sets and the WATCHDOG chains and fills the sets with ips
+func (s *IPSet) Setup(ips []string) error {
+	for _, fam := range families {
+		set := ipsetName(fam)
+		if err := s.run.Run("", "ipset", "create", set, "hash:ip", "family", ipsetFamilies[fam], "-exist"); err != nil {
+			return err
+		}
+		if err := s.run.Run("", "ipset", "flush", set); err != nil {
+			return err
+		}
+
+		bin := iptablesBinaries[fam]
+		if err := setupChain(s.run, bin); err != nil {
+			return err
+		}
+		if err := s.run.Run("", bin, "-A", ChainName, "-m", "set", "--match-set", set, "src", "-j", "DROP"); err != nil {
+			return err
+		}
+	}
+	for _, ip := range ips {
+		if err := s.Block(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Block adds ip to its family's set
+func (s *IPSet) Block(ip string) error {
+	fam, err := family(ip)
+	if err != nil {
+		return err
+	}
+	return s.run.Run("", "ipset", "add", ipsetName(fam), ip, "-exist")
+}
+
+// Unblock removes ip from its family's set
+func (s *IPSet) Unblock(ip string) error {
+	fam, err := family(ip)
+	if err != nil {
+		return err
+	}
+	return s.run.Run("", "ipset", "del", ipsetName(fam), ip, "-exist")
+}
+
+// Teardown removes the WATCHDOG chains and destroys the sets
+func (s *IPSet) Teardown() error {
+	for _, fam := range families {
+		if err := teardownChain(s.run, iptablesBinaries[fam]); err != nil {
+			return err
+		}
+		set := ipsetName(fam)
+		if err := s.run.Run("", "ipset", "list", "-n", set); err != nil {
+			continue // the set does not exist
+		}
+		if err := s.run.Run("", "ipset", "destroy", set); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package firewall
+
+// IPTables blocks IPs with one DROP rule per IP in a WATCHDOG chain that is
+// jumped to from INPUT, using iptables for IPv4 and ip6tables for IPv6.
+type IPTables struct {
+	run Runner
+}
+
+// families lists the IP families in the order the backends configure them
+var families = []string{"4", "6"}
+
+var iptablesBinaries = map[string]string{"4": "iptables", "6": "ip6tables"}
+
+// Setup recreates the WATCHDOG chain in both families and blocks ips
+func (t *IPTables) Setup(ips []string) error {
+	for _, fam := range families {
+		if err := setupChain(t.run, iptablesBinaries[fam]); err != nil {
+			return err
+		}
+	}
+	for _, ip := range ips {
+		if err := t.Block(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Block appends a DROP rule for ip, replacing an existing one
+func (t *IPTables) Block(ip string) error {
+	fam, err := family(ip)
+	if err != nil {
+		return err
+	}
+	bin := iptablesBinaries[fam]
+	_ = t.run.Run("", bin, "-D", ChainName, "-s", ip, "-j", "DROP") // drop a duplicate, if any
+	return t.run.Run("", bin, "-A", ChainName, "-s", ip, "-j", "DROP")
+}
+
+// Unblock deletes the DROP rule for ip. A missing rule is not an error.
+func (t *IPTables) Unblock(ip string) error {
+	fam, err := family(ip)
+	if err != nil {
+		return err
+	}
+	_ = t.run.Run("", iptablesBinaries[fam], "-D", ChainName, "-s", ip, "-j", "DROP")
+	return nil
+}
+
+// Teardown removes the WATCHDOG chain from both families
+func (t *IPTables) Teardown() error {
+	for _, fam := range families {
+		if err := teardownChain(t.run, iptablesBinaries[fam]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupChain creates (or flushes) the WATCHDOG chain and makes INPUT jump to
+// it first
+func setupChain(run Runner, bin string) error {
+	_ = run.Run("", bin, "-N", ChainName) // fails if the chain already exists
+	if err := run.Run("", bin, "-F", ChainName); err != nil {
+		return err
+	}
+	_ = run.Run("", bin, "-D", "INPUT", "-j", ChainName)
+	return run.Run("", bin, "-I", "INPUT", "-j", ChainName)
+}
+
+// teardownChain removes the jump from INPUT and deletes the WATCHDOG chain.
+// Nothing is done if the chain does not exist.
+func teardownChain(run Runner, bin string) error {
+	if err := run.Run("", bin, "-n", "-L", ChainName); err != nil {
+		return nil
+	}
+	_ = run.Run("", bin, "-D", "INPUT", "-j", ChainName)
+	if err := run.Run("", bin, "-F", ChainName); err != nil {
+		return err
+	}
+	return run.Run("", bin, "-X", ChainName)
+}
@@ -0,0 +1,69 @@
+package firewall
+
+import "fmt"
+
+// NFTables keeps blocked IPs in two sets of an "inet watchdog" table whose
+// input chain drops traffic from them.
+type NFTables struct {
+	run Runner
+}
+
+// nftRuleset creates the watchdog table. It runs after any old table has been
+// deleted, so it always starts from an empty state.
+var nftRuleset = fmt.Sprintf(`table inet %[1]s {
+	set blocked4 {
+		type ipv4_addr
+	}
+	set blocked6 {
+		type ipv6_addr
+	}
+	chain input {
+		type filter hook input priority filter - 10; policy accept;
+		ip saddr @blocked4 drop
+		ip6 saddr @blocked6 drop
+	}
+}
+`, TableName)
+
+// Setup recreates the watchdog table and adds ips to its sets
+func (n *NFTables) Setup(ips []string) error {
+	if err := n.Teardown(); err != nil {
+		return err
+	}
+	if err := n.run.Run(nftRuleset, "nft", "-f", "-"); err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if err := n.Block(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Block adds ip to the set of its family
+func (n *NFTables) Block(ip string) error {
+	fam, err := family(ip)
+	if err != nil {
+		return err
+	}
+	return n.run.Run("", "nft", "add", "element", "inet", TableName, "blocked"+fam, "{", ip, "}")
+}
+
+// Unblock removes ip from the set of its family. A missing element is not an error.
+func (n *NFTables) Unblock(ip string) error {
+	fam, err := family(ip)
+	if err != nil {
+		return err
+	}
+	_ = n.run.Run("", "nft", "delete", "element", "inet", TableName, "blocked"+fam, "{", ip, "}")
+	return nil
+}
+
+// Teardown deletes the watchdog table if it exists
+func (n *NFTables) Teardown() error {
+	if err := n.run.Run("", "nft", "list", "table", "inet", TableName); err != nil {
+		return nil
+	}
+	return n.run.Run("", "nft", "delete", "table", "inet", TableName)
+}
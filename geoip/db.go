@@ -0,0 +1,109 @@
+package geoip
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"sync"
+	"time"
+	"watchdog/logging"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// debounce groups the events of a database file being copied or replaced
+const debounce = time.Second
+
+// DB is a database file that can be reloaded while lookups are running
+type DB struct {
+	path string
+
+	mu     sync.RWMutex
+	reader *maxminddb.Reader
+}
+
+// Open opens the database at path
+func Open(path string) (*DB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GeoIP database %s: %w", path, err)
+	}
+	return &DB{path: path, reader: reader}, nil
+}
+
+// lookup decodes the entry of addr into record, which is left untouched when
+// the database has no entry for addr
+func (d *DB) lookup(addr netip.Addr, record any) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.reader.Lookup(net.IP(addr.AsSlice()), record)
+}
+
+// Reload opens the database file again. On error the loaded database is kept.
+func (d *DB) Reload() error {
+	reader, err := maxminddb.Open(d.path)
+	if err != nil {
+		return fmt.Errorf("failed to reload GeoIP database %s: %w", d.path, err)
+	}
+
+	d.mu.Lock()
+	old := d.reader
+	d.reader = reader
+	d.mu.Unlock()
+	return old.Close()
+}
+
+// Watch reloads the database whenever its file changes, until ctx is done
+func (d *DB) Watch(ctx context.Context) error {
+	path, err := filepath.Abs(d.path)
+	if err != nil {
+		return err
+	}
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %w", d.path, err)
+	}
+	defer fsw.Close()
+	// Watch the directory, updaters replace the file instead of writing it
+	if err := fsw.Add(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("failed to watch %s: %w", filepath.Dir(path), err)
+	}
+
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-fsw.Events:
+			if !ok {
+				return nil
+			}
+			if name, _ := filepath.Abs(event.Name); name == path && !event.Has(fsnotify.Remove) {
+				timer = time.After(debounce)
+			}
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Error("Error watching GeoIP database", "path", d.path, logging.KeyError, err)
+		case <-timer:
+			timer = nil
+			if err := d.Reload(); err != nil {
+				slog.Error("Keeping the loaded GeoIP database", logging.KeyError, err)
+				continue
+			}
+			slog.Info("Reloaded GeoIP database", "path", d.path)
+		}
+	}
+}
+
+// Close closes the database
+func (d *DB) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.reader.Close()
+}
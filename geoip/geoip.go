@@ -0,0 +1,99 @@
+// Package geoip looks IP addresses up in local MaxMind or DB-IP databases.
+// No network calls are made.
+package geoip
+
+import (
+	"fmt"
+	"net/netip"
+	"watchdog/models"
+)
+
+// asnRecord holds the fields of an ASN database entry
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// cityRecord holds the fields of a city or country database entry. Traits
+// are only filled by databases that also carry the autonomous system.
+type cityRecord struct {
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Traits asnRecord `maxminddb:"traits"`
+}
+
+// ASN looks up the autonomous system of IPs in an ASN database, such as
+// GeoLite2-ASN.mmdb or dbip-asn-lite.mmdb
+type ASN struct {
+	*DB
+}
+
+// OpenASN opens the ASN database at path
+func OpenASN(path string) (*ASN, error) {
+	db, err := Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ASN database: %w", err)
+	}
+	return &ASN{DB: db}, nil
+}
+
+// Lookup returns the number and organization of the autonomous system addr
+// belongs to. ok is false when the database has no entry for addr.
+func (a *ASN) Lookup(addr netip.Addr) (number uint, organization string, ok bool) {
+	var record asnRecord
+	if err := a.lookup(addr, &record); err != nil || record.Number == 0 {
+		return 0, "", false
+	}
+	return record.Number, record.Organization, true
+}
+
+// Locator finds where IPs are, from a city or country database such as
+// GeoLite2-City.mmdb or dbip-city-lite.mmdb and an optional ASN database
+type Locator struct {
+	city *DB
+	asn  *ASN
+}
+
+// NewLocator returns a Locator that reads city, and asn when it is not nil
+func NewLocator(city *DB, asn *ASN) *Locator {
+	return &Locator{city: city, asn: asn}
+}
+
+// Locate returns the location of ip, nil when it is not a valid IP or the
+// databases have no entry for it. A nil Locator locates nothing.
+func (l *Locator) Locate(ip string) *models.Geo {
+	if l == nil {
+		return nil
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+
+	var record cityRecord
+	if err := l.city.lookup(addr, &record); err != nil {
+		return nil
+	}
+	geo := models.Geo{
+		Country:     record.Country.ISOCode,
+		CountryName: record.Country.Names["en"],
+		City:        record.City.Names["en"],
+		ASN:         record.Traits.Number,
+		ASOrg:       record.Traits.Organization,
+	}
+	if l.asn != nil {
+		if number, organization, ok := l.asn.Lookup(addr); ok {
+			geo.ASN, geo.ASOrg = number, organization
+		}
+	}
+	if geo == (models.Geo{}) {
+		return nil
+	}
+	return &geo
+}
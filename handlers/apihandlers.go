@@ -1,275 +1,203 @@
 package handlers
 
 import (
-	"encoding/json"
-	"os"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
 	"time"
+	"watchdog/audit"
+	"watchdog/bans"
+	"watchdog/logging"
 	"watchdog/models"
+	"watchdog/storage"
 
 	"github.com/gofiber/fiber/v2"
-	"gorm.io/gorm"
 )
 
-// APIAddUserRedis - Handler to add user in Redis
-func APIAddUserRedis(c *fiber.Ctx) error {
-	var user models.User
-	if err := c.BodyParser(&user); err != nil {
-		return c.Status(400).SendString("Invalid input")
-	}
-
-	// Set user in Redis
-	if err := rdb.Set(ctx, user.Email, user.Limit, 0).Err(); err != nil {
-		return c.Status(500).SendString("Failed to add user to Redis")
-	}
-
-
-	return c.Status(201).JSON(user)
-}
-
-// APIDeleteUserRedis - Handler to delete user in Redis
-
-func APIDeleteUserRedis(c *fiber.Ctx) error {
-	email := c.Params("email")
-
-	// Delete user from Redis
-	if err := rdb.Del(ctx, email).Err(); err != nil {
-		return c.Status(500).SendString("Failed to delete user from Redis")
+// APIAddUser - Handler to add a user with an optional device limit. Existing
+// users are refused, their limit is changed with APISetUserLimit.
+func (h *Handler) APIAddUser(c *fiber.Ctx) error {
+	var body struct {
+		Email string `json:"email"`
+		Limit *int   `json:"limit"`
 	}
-	return c.Status(204).SendString("")
-}
-
-// APIAddUserJSON - Handler to add user in JSON
-func APIAddUserJSON(c *fiber.Ctx) error {
-	var newUser models.User
-	if err := c.BodyParser(&newUser); err != nil {
+	if err := c.BodyParser(&body); err != nil || body.Email == "" {
 		return c.Status(400).SendString("Invalid input")
 	}
-
-	mu.Lock()
-	defer mu.Unlock()
-
-	// Read current users from users.json
-	data, err := os.ReadFile("storage/users.json")
-	if err != nil {
-		return c.Status(500).SendString("Failed to read users")
+	if body.Limit != nil && *body.Limit < 0 {
+		return c.Status(400).SendString("Invalid limit")
 	}
 
-	var users []models.User
-	if err := json.Unmarshal(data, &users); err != nil {
-		return c.Status(500).SendString("Failed to parse users JSON")
+	_, err := h.store.GetUser(body.Email)
+	if err == nil {
+		return c.Status(409).SendString("User already exists")
 	}
-
-	// Append new user
-	users = append(users, newUser)
-
-	// Write updated data back to file
-	updatedData, err := json.Marshal(users)
-	if err != nil {
-		return c.Status(500).SendString("Failed to marshal updated users")
+	if !errors.Is(err, storage.ErrNotFound) {
+		slog.Error("Error getting user", logging.KeyUser, body.Email, logging.KeyError, err)
+		return c.Status(500).SendString("Failed to add user")
 	}
 
-	if err := os.WriteFile("storage/users.json", updatedData, 0644); err != nil {
-		return c.Status(500).SendString("Failed to write updated users")
+	now := time.Now()
+	newUser := models.User{Email: body.Email, Limit: body.Limit, CreatedAt: now, UpdatedAt: now}
+	err = h.store.AddUser(&newUser)
+	h.record(c, audit.UserAdd, newUser.Email, limitDetail(newUser.Limit), err)
+	if err != nil {
+		return c.Status(500).SendString("Failed to add user")
 	}
 
-
 	return c.Status(201).JSON(newUser)
 }
 
-// APIDeleteUserJSON - Handler to delete user in JSON
-func APIDeleteUserJSON(c *fiber.Ctx) error {
+// APISetUserLimit - Handler to set the device limit of a user. A null limit
+// makes the default apply again, 0 means no limit. Users that were not seen
+// yet are created.
+func (h *Handler) APISetUserLimit(c *fiber.Ctx) error {
 	email := c.Params("email")
-
-	mu.Lock()
-	defer mu.Unlock()
-
-	// Read current users from users.json
-	data, err := os.ReadFile("storage/users.json")
-	if err != nil {
-		return c.Status(500).SendString("Failed to read users")
+	var body struct {
+		Limit *int `json:"limit"`
 	}
-
-	var users []models.User
-	if err := json.Unmarshal(data, &users); err != nil {
-		return c.Status(500).SendString("Failed to parse users JSON")
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).SendString("Invalid input")
 	}
-
-	// Find and delete the user
-	for i, user := range users {
-		if user.Email == email {
-			users = append(users[:i], users[i+1:]...) // Remove user
-			break
-		}
+	if body.Limit != nil && *body.Limit < 0 {
+		return c.Status(400).SendString("Invalid limit")
 	}
 
-	// Write updated data back to file
-	updatedData, err := json.Marshal(users)
+	err := h.store.UpdateUser(email, func(user *models.User) error {
+		user.Limit = body.Limit
+		return nil
+	})
+	if errors.Is(err, storage.ErrNotFound) {
+		now := time.Now()
+		err = h.store.AddUser(&models.User{Email: email, Limit: body.Limit, CreatedAt: now, UpdatedAt: now})
+	}
+	h.record(c, audit.UserLimit, email, limitDetail(body.Limit), err)
 	if err != nil {
-		return c.Status(500).SendString("Failed to marshal updated users")
+		slog.Error("Error setting user limit", logging.KeyUser, email, logging.KeyError, err)
+		return c.Status(500).SendString("Failed to set limit")
 	}
 
-	if err := os.WriteFile("storage/users.json", updatedData, 0644); err != nil {
-		return c.Status(500).SendString("Failed to write updated users")
+	user, err := h.store.GetUser(email)
+	if err != nil {
+		slog.Error("Error getting user", logging.KeyUser, email, logging.KeyError, err)
+		return c.Status(500).SendString("Failed to get user")
 	}
-
-	return c.Status(204).SendString("")
+	policy := h.enforce.Policy()
+	slog.Info("User limit changed", logging.KeyUser, email, "limit", user.DeviceLimit(policy.DefaultLimit), "custom", user.Limit != nil)
+	return c.Status(200).JSON(detail(user, policy))
 }
 
-// APIAddUserSQLite - Handler to add user in SQLite
-func APIAddUserSQLite(c *fiber.Ctx, db *gorm.DB) error {
-	var newUser models.User
-	if err := c.BodyParser(&newUser); err != nil {
-		return c.Status(400).SendString("Invalid input")
-	}
+// APIDeleteUser - Handler to delete a user. Disabled users are refused until
+// the enforcer re-enables them, otherwise they would stay disabled in Marzban.
+func (h *Handler) APIDeleteUser(c *fiber.Ctx) error {
+	email := c.Params("email")
 
-	if err := db.Create(&newUser).Error; err != nil {
-		return c.Status(500).SendString("Failed to add user to SQLite")
+	user, err := h.store.GetUser(email)
+	if err == nil && user.Disabled() {
+		return c.Status(409).SendString("User is disabled until " + user.DisabledUntil.Format(time.RFC3339) + ", it can be deleted once re-enabled")
+	}
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		slog.Error("Error getting user", logging.KeyUser, email, logging.KeyError, err)
+		return c.Status(500).SendString("Failed to delete user")
 	}
 
-	return c.Status(201).JSON(newUser)
-}
-
-// APIDeleteUserSQLite - Handler to delete user in SQLite
-func APIDeleteUserSQLite(c *fiber.Ctx, db *gorm.DB) error {
-	email := c.Params("email")
-
-	if err := db.Where("email = ?", email).Delete(&models.User{}).Error; err != nil {
-		return c.Status(500).SendString("Failed to delete user from SQLite")
+	err = h.store.DeleteUser(email)
+	h.record(c, audit.UserDelete, email, "", err)
+	if err != nil {
+		return c.Status(500).SendString("Failed to delete user")
 	}
 
 	return c.Status(204).SendString("")
 }
 
-
-// APIBlockIPRedis - Handler to block an IP in Redis
-func APIBlockIPRedis(c *fiber.Ctx) error {
+// APIBlockIP - Handler to block an IP. The ban lasts ban_time minutes (query
+// parameter, BAN_TIME by default), or forever with permanent=true.
+func (h *Handler) APIBlockIP(c *fiber.Ctx) error {
 	ip := c.Params("ip")
-	banTime := 5 // Ban time in minutes
-
-	// Set blocked IP in Redis
-	if err := rdb.Set(ctx, ip, banTime, 0).Err(); err != nil {
-		return c.Status(500).SendString("Failed to block IP")
+	if net.ParseIP(ip) == nil {
+		return c.Status(400).SendString("Invalid IP address")
 	}
 
-	return c.Status(200).SendString("IP blocked successfully")
-}
-
-// APIBlockIPJSON - Handler to block an IP in JSON
-func APIBlockIPJSON(c *fiber.Ctx) error {
-	ip := c.Params("ip")
-	banTime := 10 // Ban time in minutes
-
-	mu.Lock()
-	defer mu.Unlock()
-
-	// Read existing blocked IPs from blocked_ips.json
-	data, err := os.ReadFile("storage/blocked_ips.json")
-	if err != nil {
-		return c.Status(500).SendString("Failed to read blocked IPs")
+	var duration time.Duration
+	if c.QueryBool("permanent") {
+		duration = -1
+	} else if c.Query("ban_time") != "" {
+		minutes, err := strconv.Atoi(c.Query("ban_time"))
+		if err != nil || minutes <= 0 {
+			return c.Status(400).SendString("Invalid ban_time")
+		}
+		duration = time.Duration(minutes) * time.Minute
 	}
 
-	var blockedIPs []models.BlockedIP
-	if err := json.Unmarshal(data, &blockedIPs); err != nil {
-		return c.Status(500).SendString("Failed to parse blocked IPs JSON")
+	blockedIP, err := h.bans.Ban(ip, duration)
+	detail := "default ban time"
+	if duration < 0 {
+		detail = "permanent"
+	} else if duration > 0 {
+		detail = "for " + duration.String()
 	}
-
-	// Add new IP to blocked list
-	newBlockedIP := models.BlockedIP{
-		IP:       ip,
-		BanTime:  banTime,
-		BannedAt: time.Now().Unix(),
+	h.record(c, audit.IPBlock, ip, detail, err)
+	if errors.Is(err, bans.ErrWhitelisted) {
+		return c.Status(403).SendString("IP is whitelisted and cannot be blocked")
 	}
-	blockedIPs = append(blockedIPs, newBlockedIP)
-
-	// Write updated data back to file
-	updatedData, err := json.Marshal(blockedIPs)
 	if err != nil {
-		return c.Status(500).SendString("Failed to marshal updated blocked IPs")
-	}
-
-	if err := os.WriteFile("storage/blocked_ips.json", updatedData, 0644); err != nil {
-		return c.Status(500).SendString("Failed to write updated blocked IPs")
-	}
-
-	return c.Status(200).SendString("IP blocked successfully")
-}
-
-// APIBlockIPSQLite - Handler to block an IP in SQLite
-func APIBlockIPSQLite(c *fiber.Ctx, db *gorm.DB) error {
-	ip := c.Params("ip")
-	banTime := 10 // Ban time in minutes
-
-	blockedIP := models.BlockedIP{
-		IP:       ip,
-		BanTime:  banTime,
-		BannedAt: time.Now().Unix(),
-	}
-
-	if err := db.Create(&blockedIP).Error; err != nil {
+		slog.Error("Error blocking IP", logging.KeyIP, ip, logging.KeyError, err)
 		return c.Status(500).SendString("Failed to block IP")
 	}
 
-	return c.Status(200).SendString("IP blocked successfully")
+	return c.Status(200).JSON(blockedIP)
 }
 
-// APIUnblockIPRedis - Handler to unblock an IP in Redis
-func APIUnblockIPRedis(c *fiber.Ctx) error {
+// APIUnblockIP - Handler to unblock an IP
+func (h *Handler) APIUnblockIP(c *fiber.Ctx) error {
 	ip := c.Params("ip")
+	if net.ParseIP(ip) == nil {
+		return c.Status(400).SendString("Invalid IP address")
+	}
 
-	// Delete IP from Redis
-	if err := rdb.Del(ctx, ip).Err(); err != nil {
+	err := h.bans.Unban(ip)
+	h.record(c, audit.IPUnblock, ip, "", err)
+	if err != nil {
+		slog.Error("Error unblocking IP", logging.KeyIP, ip, logging.KeyError, err)
 		return c.Status(500).SendString("Failed to unblock IP")
 	}
 
 	return c.Status(200).SendString("IP unblocked successfully")
 }
 
-// APIUnblockIPJSON - Handler to unblock an IP in JSON
-func APIUnblockIPJSON(c *fiber.Ctx) error {
-	ip := c.Params("ip")
-
-	mu.Lock()
-	defer mu.Unlock()
+// APIStreams - Handler to list the log streams and their connection state
+func (h *Handler) APIStreams(c *fiber.Ctx) error {
+	return c.Status(200).JSON(h.streams.States())
+}
 
-	// Read existing blocked IPs from blocked_ips.json
-	data, err := os.ReadFile("storage/blocked_ips.json")
-	if err != nil {
-		return c.Status(500).SendString("Failed to read blocked IPs")
-	}
+// APIGetLogLevel - Handler to read the log level
+func (h *Handler) APIGetLogLevel(c *fiber.Ctx) error {
+	return c.Status(200).JSON(fiber.Map{"level": logging.Level()})
+}
 
-	var blockedIPs []models.BlockedIP
-	if err := json.Unmarshal(data, &blockedIPs); err != nil {
-		return c.Status(500).SendString("Failed to parse blocked IPs JSON")
+// APISetLogLevel - Handler to change the log level until the next restart or
+// configuration reload
+func (h *Handler) APISetLogLevel(c *fiber.Ctx) error {
+	var body struct {
+		Level string `json:"level"`
 	}
-
-	// Find and delete the IP
-	for i, blockedIP := range blockedIPs {
-		if blockedIP.IP == ip {
-			blockedIPs = append(blockedIPs[:i], blockedIPs[i+1:]...) // Remove IP
-			break
-		}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).SendString("Invalid input")
 	}
-
-	// Write updated data back to file
-	updatedData, err := json.Marshal(blockedIPs)
+	err := logging.SetLevel(body.Level)
+	h.record(c, audit.LogLevel, "log", body.Level, err)
 	if err != nil {
-		return c.Status(500).SendString("Failed to marshal updated blocked IPs")
-	}
-
-	if err := os.WriteFile("storage/blocked_ips.json", updatedData, 0644); err != nil {
-		return c.Status(500).SendString("Failed to write updated blocked IPs")
+		return c.Status(400).SendString(err.Error())
 	}
-
-	return c.Status(200).SendString("IP unblocked successfully")
+	slog.Info("Log level changed", "level", logging.Level())
+	return c.Status(200).JSON(fiber.Map{"level": logging.Level()})
 }
 
-// APIUnblockIPSQLite - Handler to unblock an IP in SQLite
-func APIUnblockIPSQLite(c *fiber.Ctx, db *gorm.DB) error {
-	ip := c.Params("ip")
-
-	if err := db.Where("ip = ?", ip).Delete(&models.BlockedIP{}).Error; err != nil {
-		return c.Status(500).SendString("Failed to unblock IP")
+// limitDetail describes a device limit set through the API for the audit log
+func limitDetail(limit *int) string {
+	if limit == nil {
+		return "default limit"
 	}
-
-	return c.Status(200).SendString("IP unblocked successfully")
+	return "limit " + strconv.Itoa(*limit)
 }
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"watchdog/audit"
+	"watchdog/models"
+	"watchdog/storage"
+	"watchdog/storage/storagetest"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestAPIDeleteUser(t *testing.T) {
+	store := storagetest.NewJSONStore(t)
+	h := New(Options{Store: store, Audit: audit.New(store)})
+	app := fiber.New()
+	app.Delete("/api/user/delete/:email", h.APIDeleteUser)
+
+	now := time.Now()
+	until := now.Add(time.Hour)
+	for _, user := range []models.User{
+		{Email: "12.alice", DisabledAt: &now, DisabledUntil: &until, DisabledReason: "connected from 2 devices, limit is 1"},
+		{Email: "3.bob"},
+	} {
+		if err := store.AddUser(&user); err != nil {
+			t.Fatalf("AddUser() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		email  string
+		status int
+		// deleted is whether the user is gone afterwards
+		deleted bool
+	}{
+		{"12.alice", http.StatusConflict, false},
+		{"3.bob", http.StatusNoContent, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.email, func(t *testing.T) {
+			resp, err := app.Test(httptest.NewRequest(http.MethodDelete, "/api/user/delete/"+tt.email, nil))
+			if err != nil {
+				t.Fatalf("app.Test() error = %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			_, err = store.GetUser(tt.email)
+			if deleted := errors.Is(err, storage.ErrNotFound); deleted != tt.deleted {
+				t.Errorf("deleted = %v (%v), want %v", deleted, err, tt.deleted)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"time"
+	"watchdog/logging"
+	"watchdog/models"
+	"watchdog/storage"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Limits of GET /api/audit in JSON
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// APIAudit - Handler to query the audit log, newest entries first. Query
+// parameters: actor, action, target, since and until (RFC 3339) and limit.
+// With format=jsonl the entries are exported as JSON Lines, without a limit
+// unless one is given.
+func (h *Handler) APIAudit(c *fiber.Ctx) error {
+	format := c.Query("format", "json")
+	if format != "json" && format != "jsonl" {
+		return c.Status(400).SendString("Invalid format, must be 'json' or 'jsonl'")
+	}
+
+	filter := storage.AuditFilter{
+		Actor:  c.Query("actor"),
+		Action: c.Query("action"),
+		Target: c.Query("target"),
+	}
+	for _, bound := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if raw := c.Query(bound.name); raw != "" {
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				return c.Status(400).SendString("Invalid " + bound.name + ", must be an RFC 3339 time")
+			}
+			*bound.dst = t.UTC()
+		}
+	}
+
+	if format == "json" {
+		filter.Limit = c.QueryInt("limit", defaultAuditLimit)
+		if filter.Limit < 1 || filter.Limit > maxAuditLimit {
+			return c.Status(400).SendString("Invalid limit")
+		}
+	} else if filter.Limit = c.QueryInt("limit", 0); filter.Limit < 0 {
+		return c.Status(400).SendString("Invalid limit")
+	}
+
+	entries, err := h.store.ListAudit(filter)
+	if err != nil {
+		slog.Error("Error reading audit log", logging.KeyError, err)
+		return c.Status(500).SendString("Failed to read audit log")
+	}
+	if entries == nil {
+		entries = []models.AuditEntry{}
+	}
+
+	if format == "json" {
+		return c.Status(200).JSON(entries)
+	}
+
+	c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="audit.jsonl"`)
+	c.Status(200).Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		enc := json.NewEncoder(w)
+		for i := range entries {
+			if err := enc.Encode(&entries[i]); err != nil {
+				return
+			}
+		}
+		w.Flush()
+	})
+	return nil
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"watchdog/auth"
+	"watchdog/logging"
+	"watchdog/marzban"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// APILogin - Handler to exchange the credentials of a Marzban admin for a
+// JWT. Sudo admins get the admin role, other admins read-only.
+func (h *Handler) APILogin(c *fiber.Ctx) error {
+	var body struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := c.BodyParser(&body); err != nil || body.Username == "" || body.Password == "" {
+		return c.Status(400).SendString("Invalid input")
+	}
+
+	admin, err := h.panel.Login(body.Username, body.Password)
+	if errors.Is(err, marzban.ErrInvalidCredentials) {
+		slog.Warn("Failed API login", logging.KeyUser, body.Username, logging.KeyIP, c.IP())
+		return c.Status(401).SendString("Invalid username or password")
+	}
+	if err != nil {
+		slog.Error("Error checking credentials with Marzban", logging.KeyUser, body.Username, logging.KeyError, err)
+		return c.Status(502).SendString("Failed to reach Marzban")
+	}
+
+	role := auth.ReadOnly
+	if admin.IsSudo {
+		role = auth.Admin
+	}
+	token, expires, err := h.auth.Issue("panel:"+admin.Username, role)
+	if err != nil {
+		slog.Error("Error issuing token", logging.KeyUser, admin.Username, logging.KeyError, err)
+		return c.Status(500).SendString("Failed to issue token")
+	}
+
+	slog.Info("API login", logging.KeyUser, admin.Username, "role", role.String())
+	return c.Status(200).JSON(fiber.Map{
+		"token":      token,
+		"role":       role.String(),
+		"expires_at": expires,
+	})
+}
@@ -1,277 +1,102 @@
 package handlers
 
 import (
-	"context"
-	"encoding/json"
-	"fmt"
-	"os"
-	"strconv"
-	"sync"
 	"time"
+	"watchdog/audit"
+	"watchdog/auth"
+	"watchdog/bans"
+	"watchdog/enforcer"
+	"watchdog/marzban"
 	"watchdog/models"
+	"watchdog/storage"
+	"watchdog/wsclient"
 
-	"github.com/go-redis/redis/v8"
-	"gorm.io/gorm"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var (
-	ctx = context.Background()
-	rdb *redis.Client
-	mu  sync.Mutex
-	db  *gorm.DB // Global database connection
-)
-
-// Initialize Redis client
-func InitRedis() {
-	rdb = redis.NewClient(&redis.Options{
-		Addr: "redis:6379", // Assuming Redis is running in a Docker container
-	})
-}
-
-// InitSQLite - Initialize SQLite DB
-func InitSQLite() (*gorm.DB, error) {
-	// Placeholder for actual SQLite initialization
-	// Replace with actual SQLite initialization code
-	return nil, nil
-}
-
-// GetUserJSON function to retrieve a user by email from the JSON file
-func GetUserJSON(email string, user *models.User) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	// Read current users from users.json
-	data, err := os.ReadFile("storage/users.json")
-	if err != nil {
-		return fmt.Errorf("failed to read users: %w", err)
-	}
-
-	var users []models.User
-	if err := json.Unmarshal(data, &users); err != nil {
-		return fmt.Errorf("failed to parse users JSON: %w", err)
-	}
-
-	// Search for the user by email
-	for _, u := range users {
-		if u.Email == email {
-			*user = u  // Copy the found user to the provided user pointer
-			return nil // Successfully found and returned the user
-		}
-	}
-
-	return fmt.Errorf("user with email %s not found", email) // User not found
-}
-
-// GetAllUserJSON retrieves all users from the JSON file
-func GetAllUserJSON() ([]models.User, error) {
-	mu.Lock()
-	defer mu.Unlock()
-
-	// Read current users from users.json
-	data, err := os.ReadFile("storage/users.json")
-	if err != nil {
-		return nil, fmt.Errorf("failed to read users: %w", err)
-	}
-
-	var users []models.User
-	if err := json.Unmarshal(data, &users); err != nil {
-		return nil, fmt.Errorf("failed to parse users JSON: %w", err)
-	}
-	return users, nil
-}
-
-// AddUserRedis adds a user to Redis and manages their IPs
-func AddUserRedis(user *models.User, newIP string) error {
-	// Fetch existing user data from Redis
-	existingData, err := rdb.Get(ctx, user.Email).Result()
-	if err == redis.Nil {
-		// If the user does not exist, create a new one
-		user.ActiveIPs = []string{} // Initialize if creating new user
-	} else if err != nil {
-		return fmt.Errorf("failed to get user from Redis: %v", err)
-	} else {
-		// Unmarshal existing user data
-		if err := json.Unmarshal([]byte(existingData), user); err != nil {
-			return fmt.Errorf("failed to deserialize existing user: %v", err)
-		}
-	}
-
-	// Check if the new IP is already in the ActiveIPs list
-	for _, ip := range user.ActiveIPs {
-		if ip == newIP {
-			fmt.Printf("IP %s already exists for user %s\n", newIP, user.Email)
-			return nil // Exit if the IP already exists
-		}
-	}
-
-	// Add the new IP to ActiveIPs
-	user.ActiveIPs = append(user.ActiveIPs, newIP)
-
-	// Serialize updated user struct to JSON
-	userData, err := json.Marshal(user)
-	if err != nil {
-		return fmt.Errorf("failed to serialize user: %v", err)
-	}
-
-	// Get the expiration time from the environment variable
-	expirationStr := os.Getenv("EXPIRATION_TIME")
-	expiration, err := strconv.Atoi(expirationStr)
-	if err != nil {
-		return fmt.Errorf("failed to convert expiration time: %v", err)
-	}
-
-	// Store serialized user data in Redis with a TTL
-	if err := rdb.SetEX(ctx, user.Email, userData, time.Duration(expiration)*time.Second).Err(); err != nil {
-		return fmt.Errorf("failed to add/update user in Redis: %v", err)
-	}
-
-	return nil
+// Options are the components the API works with
+type Options struct {
+	// Store reads and writes users
+	Store storage.Store
+	// Bans blocks and unblocks IPs
+	Bans *bans.Manager
+	// Streams reports the state of the log streams
+	Streams *wsclient.Manager
+	// Enforcer knows the default device limit
+	Enforcer *enforcer.Enforcer
+	// Auth protects the routes
+	Auth *auth.Authenticator
+	// Panel, when not nil, enables the login of Marzban admins
+	Panel *marzban.Client
+	// Audit records every change made through the API
+	Audit *audit.Log
 }
 
-
-// AddUserJSON adds a user to the JSON file and manages their IPs
-func AddUserJSON(newUser *models.User, newIP string) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	// Read current users from users.json
-	data, err := os.ReadFile("storage/users.json")
-	if err != nil {
-		return fmt.Errorf("failed to read users: %w", err)
-	}
-
-	var users []models.User
-	if err := json.Unmarshal(data, &users); err != nil {
-		return fmt.Errorf("failed to parse users JSON: %w", err)
-	}
-
-	// Check for existing user
-	for i, user := range users {
-		if user.Email == newUser.Email {
-			fmt.Printf("User %s found, updating IPs...\n", user.Email)
-			// Check if the new IP is already in the ActiveIPs list
-			for _, ip := range user.ActiveIPs {
-				if ip == newIP {
-					fmt.Printf("IP %s already exists for user %s\n", newIP, newUser.Email)
-					return nil // Exit if the IP already exists
-				}
-			}
-			// Add the new IP to ActiveIPs
-			users[i].ActiveIPs = append(users[i].ActiveIPs, newIP)
-			// Update the updated_at timestamp
-			users[i].UpdatedAt = time.Now()
-			break
-		}
-	}
-
-	// If the user doesn't exist, create a new user
-	newUser.ActiveIPs = []string{newIP}
-	newUser.CreatedAt = time.Now() // Set the created_at timestamp
-	newUser.UpdatedAt = time.Now() // Set the updated_at timestamp
-	users = append(users, *newUser)
-
-	// Write updated users back to JSON file
-	updatedData, err := json.Marshal(users)
-	if err != nil {
-		return fmt.Errorf("failed to marshal updated users: %w", err)
-	}
-
-	if err := os.WriteFile("storage/users.json", updatedData, 0644); err != nil {
-		return fmt.Errorf("failed to write users to JSON: %w", err)
-	}
-
-	return nil
+// Handler serves the HTTP API on top of the configured storage backend
+type Handler struct {
+	store   storage.Store
+	bans    *bans.Manager
+	streams *wsclient.Manager
+	enforce *enforcer.Enforcer
+	auth    *auth.Authenticator
+	panel   *marzban.Client
+	audit   *audit.Log
 }
 
-// AddUserSQLite adds a user to SQLite and manages their IPs
-func AddUserSQLite(newUser *models.User, newIP string) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	// Read current users from the database
-	var users []models.User
-	if err := db.Find(&users).Error; err != nil {
-		return fmt.Errorf("failed to read users from SQLite: %w", err)
-	}
-
-	// Check if the user already exists and update IPs
-	for i, user := range users {
-		if user.Email == newUser.Email {
-			// Check if the new IP is already in the ActiveIPs list
-			for _, ip := range user.ActiveIPs {
-				if ip == newIP {
-					fmt.Printf("IP %s already exists for user %s\n", newIP, newUser.Email)
-					return nil // Exit if the IP already exists
-				}
-			}
-			// Add the new IP to ActiveIPs
-			users[i].ActiveIPs = append(users[i].ActiveIPs, newIP)
-			// Update timestamps
-			users[i].UpdatedAt = time.Now()
-			// Update the user with new details
-			if err := db.Save(&users[i]).Error; err != nil {
-				return fmt.Errorf("failed to update user in SQLite: %w", err)
-			}
-			break
-		}
+// New returns a Handler for the components in opts
+func New(opts Options) *Handler {
+	return &Handler{
+		store:   opts.Store,
+		bans:    opts.Bans,
+		streams: opts.Streams,
+		enforce: opts.Enforcer,
+		auth:    opts.Auth,
+		panel:   opts.Panel,
+		audit:   opts.Audit,
 	}
-
-	// If the user doesn't exist, create a new user with the new IP
-	newUser.ActiveIPs = []string{newIP}
-	newUser.CreatedAt = time.Now()
-	newUser.UpdatedAt = time.Now()
-	if err := db.Create(newUser).Error; err != nil {
-		return fmt.Errorf("failed to add user to SQLite: %w", err)
-	}
-
-	return nil
 }
 
-func DeleteUserRedis(email string) error {
-	// Delete user from Redis
-	if err := rdb.Del(ctx, email).Err(); err != nil {
-		return fmt.Errorf("failed to delete user from Redis: %v", err)
-	}
-	return nil
+// Register mounts the API routes on app with the role each one requires
+func (h *Handler) Register(app *fiber.App) {
+	readOnly := h.auth.Require(auth.ReadOnly)
+	operator := h.auth.Require(auth.Operator)
+	admin := h.auth.Require(auth.Admin)
+
+	if h.panel != nil {
+		// Slow down password guessing
+		app.Post("/api/login", limiter.New(limiter.Config{Max: 5, Expiration: time.Minute}), h.APILogin)
+	}
+	app.Get("/api/users", readOnly, h.APIListUsers)
+	app.Get("/api/user/:email", readOnly, h.APIGetUser)
+	app.Post("/api/user/add", operator, h.APIAddUser)
+	app.Put("/api/user/:email/limit", operator, h.APISetUserLimit)
+	app.Delete("/api/user/delete/:email", operator, h.APIDeleteUser)
+	app.Get("/api/ip/blocked", readOnly, h.APIListBlockedIPs)
+	app.Post("/api/ip/block/:ip", operator, h.APIBlockIP)
+	app.Post("/api/ip/unblock/:ip", operator, h.APIUnblockIP)
+	app.Get("/api/streams", readOnly, h.APIStreams)
+	app.Get("/api/log/level", readOnly, h.APIGetLogLevel)
+	app.Put("/api/log/level", admin, h.APISetLogLevel)
+	app.Get("/api/audit", admin, h.APIAudit)
+	app.Get("/metrics", readOnly, adaptor.HTTPHandler(promhttp.Handler()))
 }
 
-func DeleteUserJSON(email string) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	// Read current users from users.json
-	data, err := os.ReadFile("storage/users.json")
-	if err != nil {
-		return fmt.Errorf("failed to read users: %v", err)
-	}
-
-	var users []models.User
-	if err := json.Unmarshal(data, &users); err != nil {
-		return fmt.Errorf("failed to parse users JSON: %v", err)
-	}
-
-	// Find and delete the user
-	for i, user := range users {
-		if user.Email == email {
-			users = append(users[:i], users[i+1:]...) // Remove user
-			break
+// record writes an audit entry for an action of the API client. The reason
+// query parameter is added to detail, which describes the action.
+func (h *Handler) record(c *fiber.Ctx, action, target, detail string, err error) {
+	actor := "anonymous"
+	if id, ok := auth.FromContext(c); ok {
+		actor = id.Subject
+	}
+	reason := detail
+	if r := c.Query("reason"); r != "" {
+		if reason != "" {
+			reason += ": "
 		}
+		reason += r
 	}
-
-	// Write updated data back to file
-	updatedData, err := json.Marshal(users)
-	if err != nil {
-		return fmt.Errorf("failed to marshal updated users: %v", err)
-	}
-
-	if err := os.WriteFile("storage/users.json", updatedData, 0644); err != nil {
-		return fmt.Errorf("failed to write updated users: %v", err)
-	}
-
-	return nil
+	h.audit.Append(models.AuditEntry{Actor: actor, Action: action, Target: target, Reason: reason, Source: c.IP()}, err)
 }
-
-// DeleteUserSQLite deletes a user from the SQLite database
-func DeleteUserSQLite(email string) {
-	db.Where("email = ?", email).Delete(&models.User{})
-}
\ No newline at end of file
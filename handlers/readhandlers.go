@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"watchdog/enforcer"
+	"watchdog/logging"
+	"watchdog/models"
+	"watchdog/storage"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Pagination defaults of GET /api/users
+const (
+	defaultPerPage = 50
+	maxPerPage     = 500
+)
+
+// userSummary is one entry of GET /api/users
+type userSummary struct {
+	Email string `json:"email"`
+	// Limit is the limit that applies to the user, CustomLimit tells whether
+	// it is the user's own or the default
+	Limit          int        `json:"limit"`
+	CustomLimit    bool       `json:"custom_limit"`
+	IPCount        int        `json:"ip_count"`
+	Devices        int        `json:"devices"`
+	Strikes        int        `json:"strikes"`
+	LastSeen       *time.Time `json:"last_seen,omitempty"`
+	DisabledUntil  *time.Time `json:"disabled_until,omitempty"`
+	DisabledReason string     `json:"disabled_reason,omitempty"`
+	// Countries are the countries of the user's IPs, empty without a GeoIP
+	// database
+	Countries []string `json:"countries"`
+}
+
+// userDetail is the response of GET /api/user/:email
+type userDetail struct {
+	*models.User
+	Limit       int  `json:"limit"`
+	CustomLimit bool `json:"custom_limit"`
+	// Devices is the number of devices counted against the limit
+	Devices int `json:"devices"`
+}
+
+// userPage is the response of GET /api/users
+type userPage struct {
+	Users   []userSummary `json:"users"`
+	Total   int           `json:"total"`
+	Page    int           `json:"page"`
+	PerPage int           `json:"per_page"`
+}
+
+// blockedIPStatus is one entry of GET /api/ip/blocked
+type blockedIPStatus struct {
+	models.BlockedIP
+	Permanent bool       `json:"permanent"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// RemainingSeconds is the time left until the ban is lifted, absent for
+	// permanent bans
+	RemainingSeconds *int64 `json:"remaining_seconds,omitempty"`
+}
+
+// APIListUsers - Handler to list users. Query parameters: search (part of
+// the email), sort (email, ips or last_seen), order (asc or desc), page
+// (from 1) and per_page.
+func (h *Handler) APIListUsers(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	perPage := c.QueryInt("per_page", defaultPerPage)
+	if page < 1 || perPage < 1 || perPage > maxPerPage {
+		return c.Status(400).SendString("Invalid page or per_page")
+	}
+	less, ok := userOrders[c.Query("sort", "email")]
+	if !ok {
+		return c.Status(400).SendString("Invalid sort, must be 'email', 'ips' or 'last_seen'")
+	}
+	order := c.Query("order", "asc")
+	if order != "asc" && order != "desc" {
+		return c.Status(400).SendString("Invalid order, must be 'asc' or 'desc'")
+	}
+
+	users, err := h.store.ListUsers()
+	if err != nil {
+		slog.Error("Error listing users", logging.KeyError, err)
+		return c.Status(500).SendString("Failed to list users")
+	}
+
+	policy := h.enforce.Policy()
+	now := time.Now()
+	search := strings.ToLower(c.Query("search"))
+	matched := make([]userSummary, 0, len(users))
+	for i := range users {
+		if search != "" && !strings.Contains(strings.ToLower(users[i].Email), search) {
+			continue
+		}
+		matched = append(matched, summarize(&users[i], policy, now))
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		if order == "desc" {
+			i, j = j, i
+		}
+		return less(&matched[i], &matched[j])
+	})
+
+	result := userPage{Users: []userSummary{}, Total: len(matched), Page: page, PerPage: perPage}
+	if start := (page - 1) * perPage; start < len(matched) {
+		result.Users = matched[start:min(start+perPage, len(matched))]
+	}
+	return c.Status(200).JSON(result)
+}
+
+// userOrders are the sort orders of GET /api/users. Ties are broken by email
+// so that pages are stable.
+var userOrders = map[string]func(a, b *userSummary) bool{
+	"email": func(a, b *userSummary) bool { return a.Email < b.Email },
+	"ips": func(a, b *userSummary) bool {
+		if a.IPCount != b.IPCount {
+			return a.IPCount < b.IPCount
+		}
+		return a.Email < b.Email
+	},
+	"last_seen": func(a, b *userSummary) bool {
+		at, bt := lastSeen(a), lastSeen(b)
+		if !at.Equal(bt) {
+			return at.Before(bt)
+		}
+		return a.Email < b.Email
+	},
+}
+
+func lastSeen(u *userSummary) time.Time {
+	if u.LastSeen == nil {
+		return time.Time{}
+	}
+	return *u.LastSeen
+}
+
+func summarize(user *models.User, policy enforcer.Policy, now time.Time) userSummary {
+	summary := userSummary{
+		Email:          user.Email,
+		Limit:          user.DeviceLimit(policy.DefaultLimit),
+		CustomLimit:    user.Limit != nil,
+		IPCount:        len(user.ActiveIPs),
+		Devices:        policy.DeviceCount(user, now),
+		Countries:      countries(user),
+		Strikes:        user.Strikes,
+		DisabledUntil:  user.DisabledUntil,
+		DisabledReason: user.DisabledReason,
+	}
+	if last := user.LastSeen(); !last.IsZero() {
+		summary.LastSeen = &last
+	}
+	return summary
+}
+
+// countries returns the sorted country codes of the user's IPs
+func countries(user *models.User) []string {
+	codes := []string{}
+	for _, ip := range user.ActiveIPs {
+		if ip.Geo != nil && ip.Geo.Country != "" && !slices.Contains(codes, ip.Geo.Country) {
+			codes = append(codes, ip.Geo.Country)
+		}
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+func detail(user *models.User, policy enforcer.Policy) userDetail {
+	if user.ActiveIPs == nil {
+		user.ActiveIPs = []models.ActiveIP{}
+	}
+	if user.StrikeHistory == nil {
+		user.StrikeHistory = []models.Strike{}
+	}
+	return userDetail{
+		User:        user,
+		Limit:       user.DeviceLimit(policy.DefaultLimit),
+		CustomLimit: user.Limit != nil,
+		Devices:     policy.DeviceCount(user, time.Now()),
+	}
+}
+
+// APIGetUser - Handler to get a user with its current IPs and limit
+func (h *Handler) APIGetUser(c *fiber.Ctx) error {
+	email := c.Params("email")
+
+	user, err := h.store.GetUser(email)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.Status(404).SendString("User not found")
+	}
+	if err != nil {
+		slog.Error("Error getting user", logging.KeyUser, email, logging.KeyError, err)
+		return c.Status(500).SendString("Failed to get user")
+	}
+	return c.Status(200).JSON(detail(user, h.enforce.Policy()))
+}
+
+// APIListBlockedIPs - Handler to list the blocked IPs with the time left on
+// their ban
+func (h *Handler) APIListBlockedIPs(c *fiber.Ctx) error {
+	blockedIPs, err := h.store.ListBlockedIPs()
+	if err != nil {
+		slog.Error("Error listing blocked IPs", logging.KeyError, err)
+		return c.Status(500).SendString("Failed to list blocked IPs")
+	}
+	sort.Slice(blockedIPs, func(i, j int) bool { return blockedIPs[i].IP < blockedIPs[j].IP })
+
+	now := time.Now()
+	result := make([]blockedIPStatus, 0, len(blockedIPs))
+	for _, blocked := range blockedIPs {
+		status := blockedIPStatus{BlockedIP: blocked, Permanent: blocked.Permanent()}
+		if !status.Permanent {
+			expiresAt := blocked.ExpiresAt()
+			remaining := int64(max(expiresAt.Sub(now), 0) / time.Second)
+			status.ExpiresAt = &expiresAt
+			status.RemainingSeconds = &remaining
+		}
+		result = append(result, status)
+	}
+	return c.Status(200).JSON(result)
+}
@@ -0,0 +1,112 @@
+// Package logging sets up Watchdog's structured logger.
+//
+// Everything is logged through log/slog. Messages carry their details as
+// fields, with the common keys below, so that they can be filtered and
+// aggregated.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Common field keys
+const (
+	KeyUser  = "user"
+	KeyIP    = "ip"
+	KeyNode  = "node"
+	KeyError = "error"
+)
+
+// Redacted replaces the value of sensitive fields
+const Redacted = "<redacted>"
+
+// sensitive are the substrings of field keys whose values are redacted
+var sensitive = []string{"token", "password", "passwd", "secret", "authorization", "dsn", "api_key"}
+
+// level is shared by every handler so that it can be changed at runtime
+var level = new(slog.LevelVar)
+
+// Setup installs the default logger. format is "text" or "json", output is
+// "stdout", "stderr" or the path of a file to append to. Messages written
+// through the standard log package are routed to the same logger. The
+// returned io.Closer closes the log file, if any.
+func Setup(format, output, lvl string) (io.Closer, error) {
+	if err := SetLevel(lvl); err != nil {
+		return nil, err
+	}
+
+	var w io.WriteCloser
+	switch output {
+	case "", "stdout":
+		w = nopCloser{os.Stdout}
+	case "stderr":
+		w = nopCloser{os.Stderr}
+	default:
+		f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file: %w", err)
+		}
+		w = f
+	}
+
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	var handler slog.Handler
+	switch format {
+	case "", "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		w.Close()
+		return nil, fmt.Errorf("invalid log format %q, must be 'text' or 'json'", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	// slog.SetDefault routes the log package through the handler, drop its own prefix
+	log.SetFlags(0)
+	return w, nil
+}
+
+// SetLevel changes the minimum level of logged messages: "debug", "info",
+// "warn" or "error"
+func SetLevel(name string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return fmt.Errorf("invalid log level %q, must be 'debug', 'info', 'warn' or 'error'", name)
+	}
+	level.Set(l)
+	return nil
+}
+
+// Level returns the name of the current level
+func Level() string {
+	return strings.ToLower(level.Level().String())
+}
+
+// Fatal logs msg with args at error level and exits
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// redact hides the values of sensitive fields
+func redact(_ []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, s := range sensitive {
+		if strings.Contains(key, s) {
+			return slog.String(a.Key, Redacted)
+		}
+	}
+	return a
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -1,165 +1,372 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
-	"strconv"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"watchdog/audit"
+	"watchdog/auth"
+	"watchdog/bans"
+	"watchdog/config"
+	"watchdog/devices"
+	"watchdog/enforcer"
+	"watchdog/firewall"
+	"watchdog/geoip"
 	"watchdog/handlers"
+	"watchdog/logging"
+	"watchdog/marzban"
+	"watchdog/metrics"
+	"watchdog/notify"
+	"watchdog/storage"
+	"watchdog/whitelist"
 	"watchdog/wsclient"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/joho/godotenv"
 )
 
-// checkAndDeleteUsers checks users in the JSON file and deletes them if necessary
-func checkUsers(queue chan<- string) {
-	err := godotenv.Load(".env")
+// shutdownTimeout bounds how long running API requests and background work
+// get to finish on shutdown, below the 10 seconds docker-compose waits before
+// it kills the container
+const shutdownTimeout = 8 * time.Second
+
+// checkUsers forgets IPs that have not been seen for a whole device window and
+// deletes users that have no IPs left and have not been updated for
+// userDeleteDelay
+func checkUsers(store storage.Store, deviceWindow, userDeleteDelay time.Duration) {
+	if pruned, err := store.PruneIPs(time.Now().Add(-deviceWindow)); err != nil {
+		slog.Error("Error pruning stale IPs", logging.KeyError, err)
+	} else if pruned > 0 {
+		slog.Info("Pruned stale IPs", "count", pruned)
+	}
+
+	users, err := store.ListUsers()
 	if err != nil {
-		log.Fatal("Error loading .env file")
-	}
-
-	userDeleteDelay , _ := strconv.Atoi(os.Getenv("USER_DELETE_DELAY"))
-    users, err := handlers.GetAllUserJSON()
-    if err != nil {
-        fmt.Println("Error retrieving users:", err)
-        return
-    }
-
-    currentTime := time.Now()
-    for _, user := range users {
-        // Calculate the time to delete based on UpdatedAt and userDeleteDelay 
-        timeToDelete := user.UpdatedAt.Add(time.Duration(userDeleteDelay) * time.Second)
-        if currentTime.After(timeToDelete) {
-            // Send user email to the queue for deletion
-            queue <- user.Email
-            fmt.Printf("User %s is scheduled for deletion\n", user.Email)
-
-			storageType := os.Getenv("STORAGE_TYPE")
-			if storageType == "" {
-				log.Fatal("STORAGE_TYPE environment variable is not set")
-			}
-			switch storageType {
-			case "redis":
-				handlers.DeleteUserRedis(user.Email)
-			case "json":
-				handlers.DeleteUserJSON(user.Email)
-			case "sqlite":
-				handlers.DeleteUserSQLite(user.Email)
-			default:
-				log.Fatal("Invalid STORAGE_TYPE specified. Must be 'redis', 'json', or 'sqlite'.")
+		slog.Error("Error retrieving users", logging.KeyError, err)
+		return
+	}
+
+	currentTime := time.Now()
+	for _, user := range users {
+		// Calculate the time to delete based on UpdatedAt and userDeleteDelay
+		timeToDelete := user.UpdatedAt.Add(userDeleteDelay)
+		// Users keep their IPs for the device window, so that devices used
+		// one after the other still count together. Disabled users stop
+		// sending traffic, keep them until the enforcer re-enables them.
+		// Users with their own limit or with strikes are kept for those.
+		if len(user.ActiveIPs) == 0 && currentTime.After(timeToDelete) && !user.Disabled() && user.Limit == nil && user.Strikes == 0 {
+			slog.Info("Deleting inactive user", logging.KeyUser, user.Email)
+			if err := store.DeleteUser(user.Email); err != nil {
+				slog.Error("Error deleting user", logging.KeyUser, user.Email, logging.KeyError, err)
 			}
-            // Here, implement removal logic from the JSON file if necessary
-        }
-    }
+		}
+	}
 }
 
-func checkActiveIPs() {
-    err := godotenv.Load(".env")
+// checkActiveIPs counts the devices seen within deviceWindow across all users
+func checkActiveIPs(store storage.Store, deviceWindow time.Duration) {
+	users, err := store.ListUsers()
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		slog.Error("Error retrieving users", logging.KeyError, err)
+		return
 	}
 
-    limit, _ := strconv.Atoi(os.Getenv("MAX_ALLOW_USERS"))
+	since := time.Now().Add(-deviceWindow)
+	totalActiveIPs := 0
+	activeUsers := 0
+	for _, user := range users {
+		devices := user.DeviceCount(since, nil)
+		if devices > 0 {
+			activeUsers++
+			metrics.UserActiveIPs.Observe(float64(devices))
+		}
+		totalActiveIPs += devices
+	}
+	metrics.ActiveUsers.Set(float64(activeUsers))
+	metrics.ActiveIPs.Set(float64(totalActiveIPs))
 
-    users, err := handlers.GetAllUserJSON()
-    if err != nil {
-        fmt.Println("Error retrieving users:", err)
-        return
-    }
+	slog.Debug("Counted active IPs", "users", activeUsers, "ips", totalActiveIPs)
+}
 
-    totalActiveIPs := 0
-    for _, user := range users {
-        totalActiveIPs += len(user.ActiveIPs)
-    }
+// enforcerPolicy returns the enforcer policy of cfg. The penalty ladder was
+// validated when the configuration was loaded. asn is nil without an ASN
+// database.
+func enforcerPolicy(cfg *config.Config, asn *geoip.ASN) enforcer.Policy {
+	ladder, _ := cfg.Limits.Ladder()
+	policy := enforcer.Policy{
+		Ladder:       ladder,
+		DeviceWindow: cfg.Limits.DeviceWindow,
+		StrikeDecay:  cfg.Limits.StrikeDecay,
+		DefaultLimit: cfg.Limits.MaxDevices,
+		Devices: devices.Grouper{
+			IPv4Prefix: cfg.Devices.IPv4Prefix,
+			IPv6Prefix: cfg.Devices.IPv6Prefix,
+		},
+	}
+	if cfg.Devices.GroupByASN && asn != nil {
+		policy.Devices.ASN = asn
+	}
+	return policy
+}
 
-    if totalActiveIPs >= limit {
-        fmt.Printf("Fuck, we've run out of IPs! Current count: %d, limit: %d\n", totalActiveIPs, limit)
-    } else {
-        fmt.Printf("Active IPs are within limit. Current count: %d, limit: %d\n", totalActiveIPs, limit)
-    }
+// watchGeoIP reloads db whenever its file is updated, until ctx is done
+func watchGeoIP(ctx context.Context, db *geoip.DB) {
+	if err := db.Watch(ctx); err != nil {
+		slog.Error("GeoIP database reload disabled", logging.KeyError, err)
+	}
 }
 
+// waitFor waits until done is closed or the deadline has passed
+func waitFor(done <-chan struct{}, name string, deadline time.Time) {
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline)):
+		slog.Warn("Stopping without waiting any longer", "component", name)
+	}
+}
+
+// newNotifier returns the Telegram notifier when it is enabled
+func newNotifier(cfg config.Telegram) notify.Notifier {
+	if !cfg.Enable {
+		return notify.Nop{}
+	}
+	return notify.NewTelegram(notify.TelegramConfig{
+		APIURL:      cfg.APIURL,
+		Token:       cfg.Token,
+		ChatID:      cfg.Admin,
+		Interval:    cfg.Interval,
+		Retries:     cfg.Retries,
+		DedupWindow: time.Minute,
+	})
+}
 
 func main() {
-	err := godotenv.Load(".env")
+	teardownFirewall := flag.Bool("firewall-teardown", false, "remove the Watchdog firewall rules and exit")
+	defaultEnvFile := ".env"
+	if path := os.Getenv("ENV_FILE"); path != "" {
+		defaultEnvFile = path
+	}
+	envFile := flag.String("env", defaultEnvFile, "the .env file (or ENV_FILE)")
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "optional YAML configuration file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\n%s\n\nFlags:\n", os.Args[0], commandsUsage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	cfg, err := config.Load(*envFile, *configFile)
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		logging.Fatal("Failed to load configuration", logging.KeyError, err)
 	}
-	sleepDuration , _ := strconv.Atoi(os.Getenv("SLEEP_DURATION")) // New line to read sleep duration
+	logFile, err := logging.Setup(cfg.Logging.Format, cfg.Logging.Output, cfg.Logging.Level)
+	if err != nil {
+		logging.Fatal("Failed to set up logging", logging.KeyError, err)
+	}
+	defer logFile.Close()
 
-	storageType := os.Getenv("STORAGE_TYPE")
-	if storageType == "" {
-		log.Fatal("STORAGE_TYPE environment variable is not set")
+	if flag.NArg() > 0 {
+		if err := runCommand(cfg, flag.Args()); err != nil {
+			logging.Fatal("Command failed", logging.KeyError, err)
+		}
+		return
 	}
-	app := fiber.New()
 
-	// WebSocket authentication and connection in a goroutine
-	token, err := wsclient.GetToken()
+	// ctx is cancelled on SIGINT or SIGTERM, which starts the shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fw, err := firewall.New(cfg.Firewall.Backend, cfg.Firewall.DryRun)
 	if err != nil {
-		log.Fatalf("Error getting token: %v", err)
+		logging.Fatal("Failed to initialize firewall", logging.KeyError, err)
+	}
+	if *teardownFirewall {
+		if err := fw.Teardown(); err != nil {
+			logging.Fatal("Failed to remove firewall rules", logging.KeyError, err)
+		}
+		slog.Info("Firewall rules removed")
 		return
 	}
 
-	go func() {
-		for {
-			wsclient.ConnectToWebSocket(token)
-			log.Println("Reconnecting in 5 seconds...")
-			time.Sleep(5 * time.Second)
+	wl, err := whitelist.Parse(cfg.Whitelist.Addresses)
+	if err != nil {
+		logging.Fatal("Failed to parse WHITELIST_ADDRESSES", logging.KeyError, err)
+	}
+	wlCtx, stopWhitelist := context.WithCancel(ctx)
+	go wl.Run(wlCtx, cfg.Whitelist.Refresh)
+
+	// The notifier is replaced when the Telegram settings are reloaded
+	notifier := notify.NewSwitch(newNotifier(cfg.Telegram))
+	defer notifier.Close()
+
+	store, err := storage.New(cfg.Storage)
+	if err != nil {
+		logging.Fatal("Failed to initialize storage", logging.KeyError, err)
+	}
+
+	// Lift bans that expired while stopped and rebuild the firewall from the rest
+	auditLog := audit.New(store)
+	banManager := bans.New(store, fw, notifier, wl, auditLog, cfg.Limits.BanTime)
+	if err := banManager.Restore(); err != nil {
+		logging.Fatal("Failed to restore IP bans", logging.KeyError, err)
+	}
+
+	app := fiber.New()
+
+	// Every Marzban API consumer shares the token, which is renewed before it
+	// expires and when the panel rejects it
+	tokens := marzban.NewTokenManager(cfg.Panel.URL(), cfg.Panel.Username, cfg.Panel.Password, func(err error) {
+		notify.Notifyf(notifier, notify.AuthFailure, "Could not log in to Marzban: %v", err)
+	})
+	if _, err := tokens.Token(); err != nil {
+		notifier.Close()
+		logging.Fatal("Error getting token", logging.KeyError, err)
+		return
+	}
+
+	panel := marzban.New(cfg.Panel.URL(), tokens)
+	var asn *geoip.ASN
+	if cfg.Devices.ASNDatabase != "" {
+		if asn, err = geoip.OpenASN(cfg.Devices.ASNDatabase); err != nil {
+			logging.Fatal("Failed to open the ASN database", logging.KeyError, err)
 		}
+		defer asn.Close()
+		go watchGeoIP(ctx, asn.DB)
+	}
+	var locator *geoip.Locator
+	if cfg.GeoIP.Database != "" {
+		city, err := geoip.Open(cfg.GeoIP.Database)
+		if err != nil {
+			logging.Fatal("Failed to open the GeoIP database", logging.KeyError, err)
+		}
+		defer city.Close()
+		go watchGeoIP(ctx, city)
+		locator = geoip.NewLocator(city, asn)
+	}
+	enforce := enforcer.New(store, panel, notifier, auditLog, enforcerPolicy(cfg, asn))
+
+	// Stream the logs of the panel's core and of every node, each reconnecting on its own
+	streams := wsclient.NewManager(wsclient.Options{
+		URL:       cfg.Panel.WebSocketURL(),
+		Interval:  cfg.Panel.LogInterval,
+		Tokens:    tokens,
+		Store:     store,
+		Whitelist: wl,
+		GeoIP:     locator,
+		OnDisconnect: func(node string) {
+			notify.Notifyf(notifier, notify.Disconnected, "Lost the connection to the log stream of %s, reconnecting", node)
+		},
+		OnReconnect: func(node string) {
+			notify.Notifyf(notifier, notify.Reconnected, "The log stream of %s is connected again", node)
+		},
+	}, panel, cfg.Panel.NodeRefresh)
+	streamsDone := make(chan struct{})
+	go func() {
+		defer close(streamsDone)
+		streams.Run(ctx)
 	}()
 
-	// Declare the queue channel with a buffer size of 5
-	queue := make(chan string, 5)
+	// live is the running configuration, replaced on every reload
+	var live atomic.Pointer[config.Config]
+	live.Store(cfg)
+
+	// Apply reloaded settings to the running components. Settings that need a
+	// restart keep their running value in next.
+	watcher := config.NewWatcher(*envFile, *configFile, cfg, func(old, next *config.Config) {
+		if err := logging.SetLevel(next.Logging.Level); err != nil {
+			slog.Error("Keeping the log level", logging.KeyError, err)
+		}
+		enforce.SetPolicy(enforcerPolicy(next, asn))
+		banManager.SetDefaultBanTime(next.Limits.BanTime)
+		streams.Reconfigure(next.Panel.LogInterval, next.Panel.NodeRefresh)
+
+		if next.Whitelist.Addresses != old.Whitelist.Addresses {
+			if err := wl.Update(next.Whitelist.Addresses); err != nil {
+				slog.Error("Keeping the previous whitelist", logging.KeyError, err)
+				next.Whitelist.Addresses = old.Whitelist.Addresses
+			}
+		}
+		if next.Whitelist.Refresh != old.Whitelist.Refresh {
+			stopWhitelist()
+			wlCtx, stopWhitelist = context.WithCancel(ctx)
+			go wl.Run(wlCtx, next.Whitelist.Refresh)
+		}
+		if next.Telegram != old.Telegram {
+			notifier.Set(newNotifier(next.Telegram))
+		}
+		live.Store(next)
+	})
+	go func() {
+		if err := watcher.Run(ctx); err != nil {
+			slog.Error("Configuration reload disabled", logging.KeyError, err)
+		}
+	}()
 
 	// Start a goroutine to handle user deletions
+	sweeperDone := make(chan struct{})
 	go func() {
+		defer close(sweeperDone)
 		for {
-			checkUsers(queue) // Call the function that checks for user deletions
-			checkActiveIPs() 
-			time.Sleep(time.Duration(sleepDuration) * time.Second) // Sleep
+			cfg := live.Load()
+			checkUsers(store, cfg.Limits.DeviceWindow, cfg.Limits.UserDeleteDelay) // Call the function that checks for user deletions
+			checkActiveIPs(store, cfg.Limits.DeviceWindow)
+			enforce.Sweep()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(cfg.Limits.SleepDuration):
+			}
 		}
 	}()
-	// Initialize storage handlers based on environment variable
-	switch storageType {
-	case "redis":
-		handlers.InitRedis()
-		app.Post("/api/user/add", handlers.APIAddUserRedis)
-		app.Delete("/api/user/delete/:email", handlers.APIDeleteUserRedis)
-		app.Post("/api/ip/block/:ip", handlers.APIBlockIPRedis)
-		app.Post("/api/ip/unblock/:ip", handlers.APIUnblockIPRedis)
-	case "json":
-		app.Post("/api/user/add", handlers.APIAddUserJSON)
-		app.Delete("/api/user/delete/:email", handlers.APIDeleteUserJSON)
-		app.Post("/api/ip/block/:ip", handlers.APIBlockIPJSON)
-		app.Post("/api/ip/unblock/:ip", handlers.APIUnblockIPJSON)
-	case "sqlite":
-		db, err := handlers.InitSQLite()
-		if err != nil {
-			log.Fatal("Failed to connect to SQLite:", err)
-		}
-		app.Post("/api/user/add", func(c *fiber.Ctx) error {
-			return handlers.APIAddUserSQLite(c, db)
-		})
-		app.Delete("/api/user/delete/:email", func(c *fiber.Ctx) error {
-			return handlers.APIDeleteUserSQLite(c, db)
-		})
-		app.Post("/api/ip/block/:ip", func(c *fiber.Ctx) error {
-			return handlers.APIBlockIPSQLite(c, db)
-		})
-		app.Post("/api/ip/unblock/:ip", func(c *fiber.Ctx) error {
-			return handlers.APIUnblockIPSQLite(c, db)
-		})
-	default:
-		log.Fatal("Invalid STORAGE_TYPE specified. Must be 'redis', 'json', or 'sqlite'.")
-	}
-
-	port := os.Getenv("API_PORT")
-	if port == "" {
-		port = "4000"
-	}
-	log.Fatal(app.Listen(":" + port))
-}
 
+	if !cfg.API.Auth {
+		slog.Warn("API authentication is disabled, anyone who can reach the API has admin access")
+	}
+	authenticator := auth.New(store, cfg.API.Auth, cfg.API.JWTSecret, cfg.API.TokenTTL)
+	var panelLogin *marzban.Client
+	if cfg.API.PanelLogin {
+		panelLogin = panel
+	}
+	handlers.New(handlers.Options{
+		Store:    store,
+		Bans:     banManager,
+		Streams:  streams,
+		Enforcer: enforce,
+		Auth:     authenticator,
+		Panel:    panelLogin,
+		Audit:    auditLog,
+	}).Register(app)
 
+	// Stop accepting requests on shutdown, which makes Listen return, and
+	// give the running ones time to finish. apiStopped receives the deadline
+	// of the whole shutdown once they did.
+	apiStopped := make(chan time.Time, 1)
+	go func() {
+		<-ctx.Done()
+		slog.Info("Shutting down")
+		deadline := time.Now().Add(shutdownTimeout)
+		if err := app.ShutdownWithTimeout(shutdownTimeout); err != nil {
+			slog.Error("API server did not shut down cleanly", logging.KeyError, err)
+		}
+		apiStopped <- deadline
+	}()
+	if err := app.Listen(fmt.Sprintf(":%d", cfg.API.Port)); err != nil {
+		logging.Fatal("API server failed", logging.KeyError, err)
+	}
+	deadline := <-apiStopped
+
+	// Ingestion and the sweeper stopped with ctx, let them finish the work at
+	// hand before the storage goes away. The notifier, GeoIP databases and
+	// log file are closed by the deferred calls.
+	waitFor(streamsDone, "log streams", deadline)
+	waitFor(sweeperDone, "sweeper", deadline)
+	banManager.Stop()
+	if err := store.Close(); err != nil {
+		slog.Error("Error closing storage", logging.KeyError, err)
+	}
+	slog.Info("Stopped")
+}
@@ -0,0 +1,186 @@
+// Package marzban is a small client for the Marzban admin API.
+package marzban
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"watchdog/metrics"
+	"watchdog/xraylog"
+)
+
+// User statuses understood by Marzban
+const (
+	StatusActive   = "active"
+	StatusDisabled = "disabled"
+)
+
+// Node statuses reported by Marzban
+const (
+	NodeConnected  = "connected"
+	NodeConnecting = "connecting"
+	NodeError      = "error"
+	NodeDisabled   = "disabled"
+)
+
+// Node is a Marzban node, a server running Xray for the panel
+type Node struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Status  string `json:"status"`
+}
+
+// ErrInvalidCredentials is returned by Login when the panel rejects the
+// username or password
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// Admin is a Marzban admin account
+type Admin struct {
+	Username string `json:"username"`
+	IsSudo   bool   `json:"is_sudo"`
+}
+
+// Client calls the Marzban admin API
+type Client struct {
+	baseURL string
+	tokens  *TokenManager
+	http    *http.Client
+}
+
+// New returns a Client for the panel at baseURL (for example
+// "https://panel.example.com:8000") that authenticates with the tokens of
+// tokens.
+func New(baseURL string, tokens *TokenManager) *Client {
+	return &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		tokens:  tokens,
+		http:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// SetUserStatus changes the status of a Marzban user, e.g. to StatusDisabled
+func (c *Client) SetUserStatus(username, status string) error {
+	body := map[string]string{"status": status}
+	return c.do("set_user_status", http.MethodPut, "/api/user/"+url.PathEscape(username), body, nil)
+}
+
+// RevokeSubscription revokes the subscription of a Marzban user, which
+// invalidates the links and keys of all the user's devices
+func (c *Client) RevokeSubscription(username string) error {
+	return c.do("revoke_sub", http.MethodPost, "/api/user/"+url.PathEscape(username)+"/revoke_sub", nil, nil)
+}
+
+// Login checks the credentials of a Marzban admin and returns the account.
+// It does not affect the token the client itself uses.
+func (c *Client) Login(username, password string) (*Admin, error) {
+	token, err := requestToken(c.http, c.baseURL, username, password)
+	var unauthorized *unauthorizedError
+	if errors.As(err, &unauthorized) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var admin Admin
+	if err := c.send("current_admin", http.MethodGet, "/api/admin", token, nil, &admin); err != nil {
+		return nil, err
+	}
+	return &admin, nil
+}
+
+// Nodes lists the nodes of the panel
+func (c *Client) Nodes() ([]Node, error) {
+	var nodes []Node
+	if err := c.do("nodes", http.MethodGet, "/api/nodes", nil, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// do sends a JSON request to the admin API and decodes the response into out
+// when it is not nil. When the panel rejects the token, the request is sent
+// once more with a new one. op names the call in the latency metric.
+func (c *Client) do(op, method, path string, in, out interface{}) error {
+	var data []byte
+	if in != nil {
+		var err error
+		if data, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		token, err := c.tokens.Token()
+		if err != nil {
+			return fmt.Errorf("failed to get token: %w", err)
+		}
+		err = c.send(op, method, path, token, data, out)
+		var unauthorized *unauthorizedError
+		if !errors.As(err, &unauthorized) || attempt > 0 {
+			return err
+		}
+		c.tokens.Invalidate(token)
+	}
+}
+
+// send sends one request with token
+func (c *Client) send(op, method, path, token string, data []byte, out interface{}) error {
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	start := time.Now()
+	resp, err := c.http.Do(req)
+	if err != nil {
+		metrics.Since(metrics.MarzbanLatency.WithLabelValues(op, "error"), start)
+		return err
+	}
+	defer resp.Body.Close()
+	metrics.Since(metrics.MarzbanLatency.WithLabelValues(op, strconv.Itoa(resp.StatusCode)), start)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err := fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(detail))
+		if resp.StatusCode == http.StatusUnauthorized {
+			return &unauthorizedError{err}
+		}
+		return err
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// unauthorizedError is returned when the panel rejects the token
+type unauthorizedError struct {
+	err error
+}
+
+func (e *unauthorizedError) Error() string { return e.err.Error() }
+func (e *unauthorizedError) Unwrap() error { return e.err }
+
+// Username returns the Marzban username for an Xray email. Marzban writes
+// emails as "<id>.<username>"; other emails are returned unchanged.
+func Username(email string) string {
+	_, username := xraylog.ParseEmail(email)
+	return username
+}
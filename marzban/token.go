@@ -0,0 +1,144 @@
+package marzban
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"watchdog/metrics"
+)
+
+// refreshMargin is how long before it expires a token is replaced
+const refreshMargin = time.Minute
+
+// TokenManager logs in to the admin API and caches the token for every
+// consumer of the API. A token is replaced shortly before the expiry read from
+// the JWT, or right away after the panel rejected it.
+type TokenManager struct {
+	baseURL  string
+	username string
+	password string
+	http     *http.Client
+	// onFailure is called when logging in fails
+	onFailure func(err error)
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time // zero when the token does not expire
+}
+
+// NewTokenManager returns a TokenManager that logs in to the panel at baseURL
+// as the given admin. onFailure, when not nil, is called with every failed
+// login.
+func NewTokenManager(baseURL, username, password string, onFailure func(err error)) *TokenManager {
+	return &TokenManager{
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		username:  username,
+		password:  password,
+		http:      &http.Client{Timeout: 10 * time.Second},
+		onFailure: onFailure,
+	}
+}
+
+// Token returns a valid token, logging in again when the cached one is
+// missing or about to expire
+func (m *TokenManager) Token() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.token != "" && (m.expires.IsZero() || time.Until(m.expires) > refreshMargin) {
+		return m.token, nil
+	}
+
+	token, err := m.login()
+	if err != nil {
+		if m.onFailure != nil {
+			m.onFailure(err)
+		}
+		return "", err
+	}
+	m.token = token
+	m.expires = tokenExpiry(token)
+	return token, nil
+}
+
+// Invalidate forgets token after the panel rejected it, so that the next
+// call to Token logs in again. A token that was already replaced is ignored.
+func (m *TokenManager) Invalidate(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.token == token {
+		m.token = ""
+	}
+}
+
+// tokenResponse is the response of the token endpoint
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+// login requests a new token with the admin credentials
+func (m *TokenManager) login() (string, error) {
+	return requestToken(m.http, m.baseURL, m.username, m.password)
+}
+
+// requestToken logs in to the panel at baseURL. It returns an
+// *unauthorizedError when the panel rejects the credentials.
+func requestToken(client *http.Client, baseURL, username, password string) (string, error) {
+	data := url.Values{}
+	data.Set("grant_type", "password")
+	data.Set("username", username)
+	data.Set("password", password)
+
+	start := time.Now()
+	resp, err := client.PostForm(baseURL+"/api/admin/token", data)
+	if err != nil {
+		metrics.Since(metrics.MarzbanLatency.WithLabelValues("token", "error"), start)
+		return "", fmt.Errorf("failed to authenticate: %w", err)
+	}
+	defer resp.Body.Close()
+	metrics.Since(metrics.MarzbanLatency.WithLabelValues("token", strconv.Itoa(resp.StatusCode)), start)
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return "", &unauthorizedError{fmt.Errorf("failed to authenticate: %s", resp.Status)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to authenticate: %s", resp.Status)
+	}
+
+	var result tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to authenticate: invalid response: %w", err)
+	}
+	if result.AccessToken == "" {
+		return "", fmt.Errorf("failed to authenticate: empty access token")
+	}
+	return result.AccessToken, nil
+}
+
+// tokenExpiry reads the exp claim of a JWT. The signature is not verified,
+// the panel does that; the expiry only decides when to log in again. It
+// returns the zero time when the token has no readable expiry.
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp float64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(claims.Exp), 0)
+}
@@ -0,0 +1,103 @@
+// Package metrics defines the Prometheus metrics exported on /metrics.
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "watchdog"
+
+var (
+	// LogLines counts the log lines received per node
+	LogLines = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "log_lines_received_total",
+		Help:      "Log lines received from Marzban, per node.",
+	}, []string{"node"})
+	// LogLinesParsed counts the access log lines parsed per node
+	LogLinesParsed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "log_lines_parsed_total",
+		Help:      "Access log lines parsed, per node.",
+	}, []string{"node"})
+	// ParseFailures counts the access log lines that could not be parsed
+	ParseFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "log_parse_failures_total",
+		Help:      "Access log lines that could not be parsed, per node.",
+	}, []string{"node"})
+	// Reconnects counts the dropped log stream connections
+	Reconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_reconnects_total",
+		Help:      "Dropped log stream connections, per node.",
+	}, []string{"node"})
+
+	// ActiveUsers is the number of users with at least one device
+	ActiveUsers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_users",
+		Help:      "Users with at least one device in the device window.",
+	})
+	// ActiveIPs is the number of devices across all users
+	ActiveIPs = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_ips",
+		Help:      "Devices in the device window across all users.",
+	})
+	// UserActiveIPs is observed for every active user on each sweep
+	UserActiveIPs = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "user_active_ips",
+		Help:      "Devices per active user, observed on each sweep.",
+		Buckets:   []float64{1, 2, 3, 4, 5, 6, 8, 10, 15, 20},
+	})
+
+	// Violations counts users found over their device limit
+	Violations = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "limit_violations_total",
+		Help:      "Users found connected from more devices than their limit.",
+	})
+	// Disables counts users disabled in Marzban
+	Disables = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "user_disables_total",
+		Help:      "Users disabled in Marzban.",
+	})
+	// Revocations counts subscriptions revoked in Marzban
+	Revocations = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "subscription_revocations_total",
+		Help:      "User subscriptions revoked in Marzban.",
+	})
+	// Bans counts banned IPs
+	Bans = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ip_bans_total",
+		Help:      "IPs banned.",
+	})
+
+	// StorageLatency is the duration of storage operations per backend
+	StorageLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Duration of storage operations, per backend and operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"backend", "operation"})
+	// MarzbanLatency is the duration of Marzban API calls
+	MarzbanLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "marzban_request_duration_seconds",
+		Help:      "Duration of Marzban API calls, per operation and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "code"})
+)
+
+// Since observes the time elapsed since start on h
+func Since(h prometheus.Observer, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
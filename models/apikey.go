@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// APIKey is a static key accepted by the HTTP API. Only a SHA-256 hash of
+// its secret is stored.
+type APIKey struct {
+	ID        string    `json:"id" gorm:"primaryKey"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// Audit results
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditEntry records an action taken through the API or by Watchdog itself
+type AuditEntry struct {
+	// ID is only set by the SQL backends
+	ID     uint64    `json:"id,omitempty" gorm:"primaryKey"`
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Target string    `json:"target"`
+	Reason string    `json:"reason,omitempty"`
+	Result string    `json:"result"`
+	Error  string    `json:"error,omitempty"`
+	// Source is the address of the API client, empty for automatic actions
+	Source string `json:"source,omitempty"`
+}
+
+func (AuditEntry) TableName() string { return "audit_log" }
@@ -1,7 +1,20 @@
 package models
 
+import "time"
+
 type BlockedIP struct {
-    IP       string `json:"ip"`
-    BanTime  int    `json:"ban_time"`
-    BannedAt int64  `json:"banned_at"`
+	IP string `json:"ip" gorm:"primaryKey"`
+	// BanTime is the ban length in minutes, 0 means the ban is permanent
+	BanTime  int   `json:"ban_time"`
+	BannedAt int64 `json:"banned_at"`
+}
+
+// Permanent reports whether the ban never expires
+func (b *BlockedIP) Permanent() bool {
+	return b.BanTime <= 0
+}
+
+// ExpiresAt returns when the ban ends. It is meaningless for permanent bans.
+func (b *BlockedIP) ExpiresAt() time.Time {
+	return time.Unix(b.BannedAt, 0).Add(time.Duration(b.BanTime) * time.Minute)
 }
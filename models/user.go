@@ -1,13 +1,177 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 )
 
 type User struct {
-	Email     string    `json:"email"`
-    Limit    int      `json:"limit"`
-	ActiveIPs []string  `json:"active_ips"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-}
\ No newline at end of file
+	Email string `json:"email" gorm:"primaryKey"`
+	// Limit is the user's own device limit, 0 for no limit. When nil the
+	// default limit (MAX_ALLOW_USERS) applies.
+	Limit     *int       `json:"limit"`
+	ActiveIPs []ActiveIP `json:"active_ips" gorm:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+
+	// DisabledAt is set while Watchdog keeps the user disabled in Marzban,
+	// until DisabledUntil, for DisabledReason
+	DisabledAt     *time.Time `json:"disabled_at,omitempty"`
+	DisabledUntil  *time.Time `json:"disabled_until,omitempty"`
+	DisabledReason string     `json:"disabled_reason,omitempty"`
+
+	// Strikes counts the user's recent limit violations, it drops by one
+	// after every clean period that starts at CleanSince
+	Strikes       int        `json:"strikes"`
+	CleanSince    *time.Time `json:"clean_since,omitempty"`
+	StrikeHistory []Strike   `json:"strike_history" gorm:"serializer:json;type:text"`
+}
+
+// MaxStrikeHistory is the number of strikes kept in a user's history
+const MaxStrikeHistory = 50
+
+// Strike is a limit violation and the penalty it got
+type Strike struct {
+	Time time.Time `json:"time"`
+	// Level is the strike count after this strike
+	Level   int    `json:"level"`
+	Penalty string `json:"penalty"`
+	Reason  string `json:"reason"`
+	// Pending is set while the penalty could not be applied in Marzban, Error
+	// tells why
+	Pending bool   `json:"pending,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// AddStrike raises the strike count and records the strike in the history,
+// dropping the oldest entries beyond MaxStrikeHistory
+func (u *User) AddStrike(strike Strike) {
+	u.Strikes = strike.Level
+	u.CleanSince = &strike.Time
+	u.StrikeHistory = append(u.StrikeHistory, strike)
+	if extra := len(u.StrikeHistory) - MaxStrikeHistory; extra > 0 {
+		u.StrikeHistory = append([]Strike(nil), u.StrikeHistory[extra:]...)
+	}
+}
+
+// LastStrike returns the most recent strike, nil if there is none
+func (u *User) LastStrike() *Strike {
+	if len(u.StrikeHistory) == 0 {
+		return nil
+	}
+	return &u.StrikeHistory[len(u.StrikeHistory)-1]
+}
+
+// Disabled reports whether Watchdog has disabled the user
+func (u *User) Disabled() bool {
+	return u.DisabledAt != nil
+}
+
+// DeviceLimit returns the user's own device limit, or defaultLimit when it
+// has none. 0 means no limit.
+func (u *User) DeviceLimit(defaultLimit int) int {
+	if u.Limit != nil {
+		return *u.Limit
+	}
+	return defaultLimit
+}
+
+// ActiveIP is an IP a user has connected from
+type ActiveIP struct {
+	IP        string    `json:"ip"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// Geo is where the IP is located, nil without a GeoIP database
+	Geo *Geo `json:"geo,omitempty"`
+}
+
+// Geo is the location of an IP according to the GeoIP database
+type Geo struct {
+	// Country is the ISO 3166-1 code of the country, e.g. "DE"
+	Country     string `json:"country,omitempty"`
+	CountryName string `json:"country_name,omitempty"`
+	City        string `json:"city,omitempty"`
+	// ASN and ASOrg identify the autonomous system, e.g. 3320 and
+	// "Deutsche Telekom AG"
+	ASN   uint   `json:"asn,omitempty"`
+	ASOrg string `json:"as_org,omitempty"`
+}
+
+// UnmarshalJSON also accepts a bare IP string, the format used before
+// per-IP timestamps were tracked
+func (a *ActiveIP) UnmarshalJSON(data []byte) error {
+	var ip string
+	if err := json.Unmarshal(data, &ip); err == nil {
+		*a = ActiveIP{IP: ip}
+		return nil
+	}
+
+	type activeIP ActiveIP // avoids recursing into this method
+	return json.Unmarshal(data, (*activeIP)(a))
+}
+
+// DeviceCount returns the number of devices the user was seen on since the
+// given time. IPs with the same key count as one device; with a nil key
+// every IP is a device.
+func (u *User) DeviceCount(since time.Time, key func(ip string) string) int {
+	devices := make(map[string]bool)
+	for _, ip := range u.ActiveIPs {
+		if ip.LastSeen.Before(since) {
+			continue
+		}
+		if key != nil {
+			devices[key(ip.IP)] = true
+		} else {
+			devices[ip.IP] = true
+		}
+	}
+	return len(devices)
+}
+
+// LastSeen returns when the user was last seen on any IP, zero if never
+func (u *User) LastSeen() time.Time {
+	var last time.Time
+	for _, ip := range u.ActiveIPs {
+		if ip.LastSeen.After(last) {
+			last = ip.LastSeen
+		}
+	}
+	return last
+}
+
+// UserIP is one active IP of a user, stored in its own table by the SQL backends
+type UserIP struct {
+	Email     string    `json:"email" gorm:"primaryKey"`
+	IP        string    `json:"ip" gorm:"primaryKey"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// The columns of ActiveIP.Geo, empty when the IP was not located
+	Country     string `json:"country"`
+	CountryName string `json:"country_name"`
+	City        string `json:"city"`
+	ASN         uint   `json:"asn" gorm:"column:asn"`
+	ASOrg       string `json:"as_org" gorm:"column:as_org"`
+}
+
+// NewUserIP returns the row of ip
+func NewUserIP(email string, ip ActiveIP) UserIP {
+	row := UserIP{Email: email, IP: ip.IP, FirstSeen: ip.FirstSeen, LastSeen: ip.LastSeen}
+	if ip.Geo != nil {
+		row.Country = ip.Geo.Country
+		row.CountryName = ip.Geo.CountryName
+		row.City = ip.Geo.City
+		row.ASN = ip.Geo.ASN
+		row.ASOrg = ip.Geo.ASOrg
+	}
+	return row
+}
+
+// ActiveIP returns the IP of the row
+func (r UserIP) ActiveIP() ActiveIP {
+	ip := ActiveIP{IP: r.IP, FirstSeen: r.FirstSeen, LastSeen: r.LastSeen}
+	geo := Geo{Country: r.Country, CountryName: r.CountryName, City: r.City, ASN: r.ASN, ASOrg: r.ASOrg}
+	if geo != (Geo{}) {
+		ip.Geo = &geo
+	}
+	return ip
+}
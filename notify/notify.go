@@ -0,0 +1,102 @@
+// Package notify sends notifications about Watchdog events to the admin.
+package notify
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Kind identifies what happened
+type Kind string
+
+const (
+	LimitViolation Kind = "limit_violation"
+	UserDisabled   Kind = "user_disabled"
+	UserEnabled    Kind = "user_enabled"
+	SubRevoked     Kind = "subscription_revoked"
+	IPBanned       Kind = "ip_banned"
+	IPUnbanned     Kind = "ip_unbanned"
+	Disconnected   Kind = "disconnected"
+	Reconnected    Kind = "reconnected"
+	AuthFailure    Kind = "auth_failure"
+)
+
+// titles are shown in front of each message
+var titles = map[Kind]string{
+	LimitViolation: "⚠️ Limit violation",
+	UserDisabled:   "⛔ User disabled",
+	UserEnabled:    "✅ User re-enabled",
+	SubRevoked:     "🔁 Subscription revoked",
+	IPBanned:       "🚫 IP banned",
+	IPUnbanned:     "🔓 IP unbanned",
+	Disconnected:   "🔌 Log stream disconnected",
+	Reconnected:    "🔗 Log stream reconnected",
+	AuthFailure:    "🔑 Authentication failed",
+}
+
+// Event is a single notification
+type Event struct {
+	Kind    Kind
+	Message string
+}
+
+// Text renders the event as a message
+func (e Event) Text() string {
+	title, ok := titles[e.Kind]
+	if !ok {
+		title = string(e.Kind)
+	}
+	return title + "\n" + e.Message
+}
+
+// Notifier delivers events. Notify must not block the caller.
+type Notifier interface {
+	Notify(event Event)
+	// Close delivers the queued events and stops the notifier
+	Close()
+}
+
+// Notifyf is a shorthand for sending an event with a formatted message
+func Notifyf(n Notifier, kind Kind, format string, args ...interface{}) {
+	n.Notify(Event{Kind: kind, Message: fmt.Sprintf(format, args...)})
+}
+
+// Nop discards every event. It is used when notifications are disabled.
+type Nop struct{}
+
+func (Nop) Notify(Event) {}
+func (Nop) Close()       {}
+
+// Switch forwards events to a notifier that can be replaced at runtime, for
+// example when the Telegram settings are reloaded
+type Switch struct {
+	mu      sync.RWMutex
+	current Notifier
+}
+
+// NewSwitch returns a Switch that forwards to n
+func NewSwitch(n Notifier) *Switch {
+	return &Switch{current: n}
+}
+
+func (s *Switch) Notify(event Event) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.current.Notify(event)
+}
+
+// Set forwards the next events to n and closes the previous notifier
+func (s *Switch) Set(n Notifier) {
+	s.mu.Lock()
+	previous := s.current
+	s.current = n
+	s.mu.Unlock()
+
+	previous.Close()
+}
+
+func (s *Switch) Close() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.current.Close()
+}
@@ -0,0 +1,215 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"watchdog/logging"
+)
+
+// DefaultTelegramAPI is the public Telegram Bot API
+const DefaultTelegramAPI = "https://api.telegram.org"
+
+// TelegramConfig configures the Telegram notifier
+type TelegramConfig struct {
+	// APIURL is the Bot API base URL, DefaultTelegramAPI when empty
+	APIURL string
+	Token  string
+	ChatID string
+	// Interval is the minimum time between two messages
+	Interval time.Duration
+	// Retries is how many times a failed message is sent again
+	Retries int
+	// DedupWindow drops a message identical to one sent within the window
+	DedupWindow time.Duration
+}
+
+// Telegram sends events to the admin chat through the Telegram Bot API.
+// Events are queued and sent by a single worker, one at least every
+// Interval, so bursts of events do not hit Telegram's rate limits.
+type Telegram struct {
+	cfg  TelegramConfig
+	http *http.Client
+	done chan struct{}
+
+	// mu guards queue against sends after Close
+	mu     sync.RWMutex
+	queue  chan Event
+	closed bool
+
+	// lastSent maps the text of recent messages to when they were sent
+	lastSent map[string]time.Time
+}
+
+// NewTelegram starts a Telegram notifier
+func NewTelegram(cfg TelegramConfig) *Telegram {
+	if cfg.APIURL == "" {
+		cfg.APIURL = DefaultTelegramAPI
+	}
+	cfg.APIURL = strings.TrimRight(cfg.APIURL, "/")
+
+	t := &Telegram{
+		cfg:      cfg,
+		http:     &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan Event, 100),
+		done:     make(chan struct{}),
+		lastSent: make(map[string]time.Time),
+	}
+	go t.run()
+	return t
+}
+
+// Notify queues event. When the queue is full the event is dropped.
+func (t *Telegram) Notify(event Event) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- event:
+	default:
+		slog.Warn("Telegram queue is full, dropping notification", "kind", event.Kind)
+	}
+}
+
+// Close sends the queued events and stops the worker
+func (t *Telegram) Close() {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.mu.Unlock()
+
+	<-t.done
+}
+
+func (t *Telegram) run() {
+	defer close(t.done)
+
+	var last time.Time
+	for event := range t.queue {
+		text := event.Text()
+		if t.duplicate(text) {
+			continue
+		}
+		if wait := t.cfg.Interval - time.Since(last); wait > 0 {
+			time.Sleep(wait)
+		}
+		if err := t.sendWithRetries(text); err != nil {
+			slog.Error("Failed to send Telegram notification", logging.KeyError, err)
+		}
+		last = time.Now()
+	}
+}
+
+// duplicate reports whether text was sent within the dedup window and
+// forgets messages that left it
+func (t *Telegram) duplicate(text string) bool {
+	if t.cfg.DedupWindow <= 0 {
+		return false
+	}
+	now := time.Now()
+	for sent, at := range t.lastSent {
+		if now.Sub(at) >= t.cfg.DedupWindow {
+			delete(t.lastSent, sent)
+		}
+	}
+	if _, ok := t.lastSent[text]; ok {
+		return true
+	}
+	t.lastSent[text] = now
+	return false
+}
+
+// sendWithRetries sends text, retrying with exponential backoff. When
+// Telegram answers 429 its retry_after is honoured instead.
+func (t *Telegram) sendWithRetries(text string) error {
+	backoff := time.Second
+	var err error
+	for attempt := 0; attempt <= t.cfg.Retries; attempt++ {
+		var retryAfter time.Duration
+		retryAfter, err = t.send(text)
+		if err == nil {
+			return nil
+		}
+		var rejected *rejectedError
+		if attempt == t.cfg.Retries || errors.As(err, &rejected) {
+			break
+		}
+		wait := backoff
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		time.Sleep(wait)
+		backoff *= 2
+	}
+	return err
+}
+
+// telegramResponse is the envelope of every Bot API response
+type telegramResponse struct {
+	OK          bool   `json:"ok"`
+	Description string `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+// send calls sendMessage once. On a rate limit it also returns how long
+// Telegram asked to wait.
+func (t *Telegram) send(text string) (time.Duration, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"chat_id":                  t.cfg.ChatID,
+		"text":                     text,
+		"disable_web_page_preview": true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	url := fmt.Sprintf("%s/bot%s/sendMessage", t.cfg.APIURL, t.cfg.Token)
+	resp, err := t.http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The error contains the URL, which contains the bot token
+		return 0, fmt.Errorf("sendMessage request failed: %w", stripToken(err, t.cfg.Token))
+	}
+	defer resp.Body.Close()
+
+	var result telegramResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("sendMessage: %s: invalid response: %w", resp.Status, err)
+	}
+	if !result.OK {
+		err := fmt.Errorf("sendMessage: %s: %s", resp.Status, result.Description)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return 0, &rejectedError{err} // e.g. a wrong chat ID, retrying will not help
+		}
+		return time.Duration(result.Parameters.RetryAfter) * time.Second, err
+	}
+	return 0, nil
+}
+
+// rejectedError is returned when Telegram refuses a message for good
+type rejectedError struct {
+	err error
+}
+
+func (e *rejectedError) Error() string { return e.err.Error() }
+func (e *rejectedError) Unwrap() error { return e.err }
+
+// stripToken hides the bot token in err
+func stripToken(err error, token string) error {
+	if token == "" {
+		return err
+	}
+	return fmt.Errorf("%s", strings.ReplaceAll(err.Error(), token, "<token>"))
+}
@@ -0,0 +1,121 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// botAPI is a Bot API stub that answers sendMessage with the queued
+// responses, then with success
+type botAPI struct {
+	mu        sync.Mutex
+	responses []botResponse
+	requests  int
+	messages  []map[string]interface{}
+}
+
+type botResponse struct {
+	status int
+	body   string
+}
+
+func (b *botAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/bottest-token/sendMessage" {
+		http.NotFound(w, r)
+		return
+	}
+	var message map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.requests++
+	response := botResponse{http.StatusOK, `{"ok": true}`}
+	if len(b.responses) > 0 {
+		response, b.responses = b.responses[0], b.responses[1:]
+	}
+	if response.status == http.StatusOK {
+		b.messages = append(b.messages, message)
+	}
+	w.WriteHeader(response.status)
+	w.Write([]byte(response.body))
+}
+
+func (b *botAPI) sent() (int, []map[string]interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.requests, b.messages
+}
+
+func newTestTelegram(t *testing.T, api *botAPI) *Telegram {
+	t.Helper()
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	return NewTelegram(TelegramConfig{
+		APIURL:      server.URL + "/",
+		Token:       "test-token",
+		ChatID:      "42",
+		Retries:     2,
+		DedupWindow: time.Minute,
+	})
+}
+
+func TestTelegramSendsAndDeduplicates(t *testing.T) {
+	api := &botAPI{}
+	telegram := newTestTelegram(t, api)
+	Notifyf(telegram, IPBanned, "%s is banned permanently", "1.2.3.4")
+	Notifyf(telegram, IPBanned, "%s is banned permanently", "1.2.3.4")
+	Notifyf(telegram, IPUnbanned, "%s is no longer banned", "1.2.3.4")
+	telegram.Close()
+
+	requests, messages := api.sent()
+	if requests != 2 || len(messages) != 2 {
+		t.Fatalf("requests = %d, messages = %v, want the duplicate dropped", requests, messages)
+	}
+	if messages[0]["chat_id"] != "42" || messages[0]["text"] != "🚫 IP banned\n1.2.3.4 is banned permanently" {
+		t.Errorf("first message = %v", messages[0])
+	}
+	if text, _ := messages[1]["text"].(string); !strings.HasPrefix(text, "🔓 IP unbanned\n") {
+		t.Errorf("second message text = %q", text)
+	}
+}
+
+func TestTelegramRetries(t *testing.T) {
+	api := &botAPI{responses: []botResponse{
+		{http.StatusTooManyRequests, `{"ok": false, "description": "Too Many Requests: retry after 1", "parameters": {"retry_after": 1}}`},
+		{http.StatusBadGateway, `{"ok": false, "description": "Bad Gateway"}`},
+	}}
+	telegram := newTestTelegram(t, api)
+	start := time.Now()
+	Notifyf(telegram, UserEnabled, "%s is active again", "alice")
+	telegram.Close()
+
+	if requests, messages := api.sent(); requests != 3 || len(messages) != 1 {
+		t.Errorf("requests = %d, messages = %d, want the third attempt delivered", requests, len(messages))
+	}
+	// retry_after, then one second of backoff doubled once
+	if elapsed := time.Since(start); elapsed < 3*time.Second {
+		t.Errorf("retries took %v, want at least 3s", elapsed)
+	}
+}
+
+func TestTelegramRejected(t *testing.T) {
+	api := &botAPI{responses: []botResponse{
+		{http.StatusBadRequest, `{"ok": false, "description": "Bad Request: chat not found"}`},
+	}}
+	telegram := newTestTelegram(t, api)
+	Notifyf(telegram, UserEnabled, "%s is active again", "alice")
+	telegram.Close()
+
+	if requests, messages := api.sent(); requests != 1 || len(messages) != 0 {
+		t.Errorf("requests = %d, messages = %d, want a rejected message not to be retried", requests, len(messages))
+	}
+}
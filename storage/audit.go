@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"time"
+	"watchdog/models"
+)
+
+// AuditFilter selects audit entries. Empty fields match every entry.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	// Since and Until bound the time of the entries, both inclusive
+	Since time.Time
+	Until time.Time
+	// Limit is the maximum number of entries returned, 0 for no limit
+	Limit int
+}
+
+// match reports whether entry is selected by the filter, ignoring Limit
+func (f AuditFilter) match(entry *models.AuditEntry) bool {
+	return (f.Actor == "" || entry.Actor == f.Actor) &&
+		(f.Action == "" || entry.Action == f.Action) &&
+		(f.Target == "" || entry.Target == f.Target) &&
+		(f.Since.IsZero() || !entry.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || !entry.Time.After(f.Until))
+}
+
+// full reports whether entries holds as many entries as the filter allows
+func (f AuditFilter) full(entries []models.AuditEntry) bool {
+	return f.Limit > 0 && len(entries) >= f.Limit
+}
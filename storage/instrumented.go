@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"time"
+	"watchdog/metrics"
+	"watchdog/models"
+)
+
+// instrumented records the latency of every operation of a Store
+type instrumented struct {
+	store   Store
+	backend string
+}
+
+// Instrument returns store with the latency of its operations exported as
+// metrics labelled with backend
+func Instrument(store Store, backend string) Store {
+	return &instrumented{store: store, backend: backend}
+}
+
+func (s *instrumented) observe(operation string, start time.Time) {
+	metrics.Since(metrics.StorageLatency.WithLabelValues(s.backend, operation), start)
+}
+
+func (s *instrumented) GetUser(email string) (*models.User, error) {
+	defer s.observe("get_user", time.Now())
+	return s.store.GetUser(email)
+}
+
+func (s *instrumented) ListUsers() ([]models.User, error) {
+	defer s.observe("list_users", time.Now())
+	return s.store.ListUsers()
+}
+
+func (s *instrumented) AddUser(user *models.User) error {
+	defer s.observe("add_user", time.Now())
+	return s.store.AddUser(user)
+}
+
+func (s *instrumented) UpsertUserIP(user *models.User, ip string, geo *models.Geo) error {
+	defer s.observe("upsert_user_ip", time.Now())
+	return s.store.UpsertUserIP(user, ip, geo)
+}
+
+func (s *instrumented) UpdateUser(email string, fn func(user *models.User) error) error {
+	defer s.observe("update_user", time.Now())
+	return s.store.UpdateUser(email, fn)
+}
+
+func (s *instrumented) ClearIPs(email string) error {
+	defer s.observe("clear_ips", time.Now())
+	return s.store.ClearIPs(email)
+}
+
+func (s *instrumented) PruneIPs(before time.Time) (int, error) {
+	defer s.observe("prune_ips", time.Now())
+	return s.store.PruneIPs(before)
+}
+
+func (s *instrumented) DeleteUser(email string) error {
+	defer s.observe("delete_user", time.Now())
+	return s.store.DeleteUser(email)
+}
+
+func (s *instrumented) BlockIP(blocked models.BlockedIP) error {
+	defer s.observe("block_ip", time.Now())
+	return s.store.BlockIP(blocked)
+}
+
+func (s *instrumented) UnblockIP(ip string) error {
+	defer s.observe("unblock_ip", time.Now())
+	return s.store.UnblockIP(ip)
+}
+
+func (s *instrumented) ListBlockedIPs() ([]models.BlockedIP, error) {
+	defer s.observe("list_blocked_ips", time.Now())
+	return s.store.ListBlockedIPs()
+}
+
+func (s *instrumented) AddAPIKey(key models.APIKey) error {
+	defer s.observe("add_api_key", time.Now())
+	return s.store.AddAPIKey(key)
+}
+
+func (s *instrumented) GetAPIKey(id string) (*models.APIKey, error) {
+	defer s.observe("get_api_key", time.Now())
+	return s.store.GetAPIKey(id)
+}
+
+func (s *instrumented) ListAPIKeys() ([]models.APIKey, error) {
+	defer s.observe("list_api_keys", time.Now())
+	return s.store.ListAPIKeys()
+}
+
+func (s *instrumented) DeleteAPIKey(id string) error {
+	defer s.observe("delete_api_key", time.Now())
+	return s.store.DeleteAPIKey(id)
+}
+
+func (s *instrumented) AppendAudit(entry models.AuditEntry) error {
+	defer s.observe("append_audit", time.Now())
+	return s.store.AppendAudit(entry)
+}
+
+func (s *instrumented) ListAudit(filter AuditFilter) ([]models.AuditEntry, error) {
+	defer s.observe("list_audit", time.Now())
+	return s.store.ListAudit(filter)
+}
+
+func (s *instrumented) Close() error {
+	return s.store.Close()
+}
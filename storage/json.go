@@ -0,0 +1,467 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"watchdog/models"
+)
+
+// JSONStore keeps users, blocked IPs and API keys in three JSON files and
+// the audit log in a JSON Lines file.
+type JSONStore struct {
+	mu             sync.Mutex
+	usersPath      string
+	blockedIPsPath string
+	apiKeysPath    string
+	auditPath      string
+	// versionPath holds the version of the stored data, see upgrades
+	versionPath string
+}
+
+// NewJSONStore returns a JSONStore backed by the given files.
+func NewJSONStore(usersPath, blockedIPsPath, apiKeysPath, auditPath string) *JSONStore {
+	return &JSONStore{
+		usersPath:      usersPath,
+		blockedIPsPath: blockedIPsPath,
+		apiKeysPath:    apiKeysPath,
+		auditPath:      auditPath,
+		versionPath:    usersPath + ".version",
+	}
+}
+
+// GetUser retrieves a user by email from the users file
+func (s *JSONStore) GetUser(email string) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users, err := s.readUsers()
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if u.Email == email {
+			return &u, nil
+		}
+	}
+	return nil, fmt.Errorf("user %s: %w", email, ErrNotFound)
+}
+
+// ListUsers retrieves all users from the users file
+func (s *JSONStore) ListUsers() ([]models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.readUsers()
+}
+
+// AddUser adds or replaces a user in the users file
+func (s *JSONStore) AddUser(user *models.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users, err := s.readUsers()
+	if err != nil {
+		return err
+	}
+
+	for i, u := range users {
+		if u.Email == user.Email {
+			users[i] = *user
+			return s.writeUsers(users)
+		}
+	}
+	return s.writeUsers(append(users, *user))
+}
+
+// UpsertUserIP adds ip to the user's active IPs, creating the user if needed
+func (s *JSONStore) UpsertUserIP(user *models.User, ip string, geo *models.Geo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users, err := s.readUsers()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i, u := range users {
+		if u.Email == user.Email {
+			users[i].ActiveIPs = touchIP(u.ActiveIPs, ip, geo, now)
+			users[i].UpdatedAt = now
+			*user = users[i]
+			return s.writeUsers(users)
+		}
+	}
+
+	// If the user doesn't exist, create a new user
+	user.ActiveIPs = touchIP(nil, ip, geo, now)
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	return s.writeUsers(append(users, *user))
+}
+
+// UpdateUser modifies a user in the users file
+func (s *JSONStore) UpdateUser(email string, fn func(user *models.User) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users, err := s.readUsers()
+	if err != nil {
+		return err
+	}
+
+	for i := range users {
+		if users[i].Email == email {
+			ips := users[i].ActiveIPs
+			if err := fn(&users[i]); err != nil {
+				return err
+			}
+			users[i].Email = email
+			users[i].ActiveIPs = ips
+			return s.writeUsers(users)
+		}
+	}
+	return fmt.Errorf("user %s: %w", email, ErrNotFound)
+}
+
+// ClearIPs removes every IP of a user from the users file
+func (s *JSONStore) ClearIPs(email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users, err := s.readUsers()
+	if err != nil {
+		return err
+	}
+
+	for i := range users {
+		if users[i].Email == email {
+			users[i].ActiveIPs = []models.ActiveIP{}
+			return s.writeUsers(users)
+		}
+	}
+	return nil
+}
+
+// PruneIPs drops IPs last seen before the given time from the users file
+func (s *JSONStore) PruneIPs(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users, err := s.readUsers()
+	if err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	for i := range users {
+		count := len(users[i].ActiveIPs)
+		users[i].ActiveIPs = pruneIPs(users[i].ActiveIPs, before)
+		pruned += count - len(users[i].ActiveIPs)
+	}
+	if pruned == 0 {
+		return 0, nil
+	}
+	return pruned, s.writeUsers(users)
+}
+
+// DeleteUser removes a user from the users file
+func (s *JSONStore) DeleteUser(email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users, err := s.readUsers()
+	if err != nil {
+		return err
+	}
+
+	for i, u := range users {
+		if u.Email == email {
+			return s.writeUsers(append(users[:i], users[i+1:]...))
+		}
+	}
+	return nil
+}
+
+// BlockIP adds or replaces an entry in the blocked IPs file
+func (s *JSONStore) BlockIP(blocked models.BlockedIP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blockedIPs, err := s.readBlockedIPs()
+	if err != nil {
+		return err
+	}
+
+	for i, b := range blockedIPs {
+		if b.IP == blocked.IP {
+			blockedIPs[i] = blocked
+			return s.writeBlockedIPs(blockedIPs)
+		}
+	}
+	return s.writeBlockedIPs(append(blockedIPs, blocked))
+}
+
+// UnblockIP removes an entry from the blocked IPs file
+func (s *JSONStore) UnblockIP(ip string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blockedIPs, err := s.readBlockedIPs()
+	if err != nil {
+		return err
+	}
+
+	for i, b := range blockedIPs {
+		if b.IP == ip {
+			return s.writeBlockedIPs(append(blockedIPs[:i], blockedIPs[i+1:]...))
+		}
+	}
+	return nil
+}
+
+// ListBlockedIPs retrieves all entries from the blocked IPs file
+func (s *JSONStore) ListBlockedIPs() ([]models.BlockedIP, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.readBlockedIPs()
+}
+
+// AddAPIKey adds an entry to the API keys file
+func (s *JSONStore) AddAPIKey(key models.APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys, err := s.readAPIKeys()
+	if err != nil {
+		return err
+	}
+	return s.writeAPIKeys(append(keys, key))
+}
+
+// GetAPIKey retrieves an API key by ID from the API keys file
+func (s *JSONStore) GetAPIKey(id string) (*models.APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys, err := s.readAPIKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if k.ID == id {
+			return &k, nil
+		}
+	}
+	return nil, fmt.Errorf("API key %s: %w", id, ErrNotFound)
+}
+
+// ListAPIKeys retrieves all entries from the API keys file
+func (s *JSONStore) ListAPIKeys() ([]models.APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.readAPIKeys()
+}
+
+// DeleteAPIKey removes an entry from the API keys file
+func (s *JSONStore) DeleteAPIKey(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys, err := s.readAPIKeys()
+	if err != nil {
+		return err
+	}
+
+	for i, k := range keys {
+		if k.ID == id {
+			return s.writeAPIKeys(append(keys[:i], keys[i+1:]...))
+		}
+	}
+	return nil
+}
+
+// AppendAudit appends an entry to the audit log file
+func (s *JSONStore) AppendAudit(entry models.AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to serialize audit entry: %w", err)
+	}
+	f, err := os.OpenFile(s.auditPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return f.Close()
+}
+
+// ListAudit reads the audit log file and returns the selected entries
+func (s *JSONStore) ListAudit(filter AuditFilter) ([]models.AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(s.auditPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+
+	var entries []models.AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry models.AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // a line cut off by a crash
+		}
+		if filter.match(&entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	slices.Reverse(entries)
+	if filter.full(entries) {
+		entries = entries[:filter.Limit]
+	}
+	return entries, nil
+}
+
+// Close waits for a running write to finish. The files stay open only while
+// they are read or written, so there is nothing else to release.
+func (s *JSONStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return nil
+}
+
+// Upgrade applies the upgrades the stored users have not had yet
+func (s *JSONStore) Upgrade() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	version := 0
+	data, err := os.ReadFile(s.versionPath)
+	if err == nil {
+		version, err = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read data version: %w", err)
+	}
+	if version >= dataVersion() {
+		return nil
+	}
+
+	users, err := s.readUsers()
+	if err != nil {
+		return err
+	}
+	changed := 0
+	for i := range users {
+		if upgradeUser(&users[i], version) {
+			changed++
+		}
+	}
+	if changed > 0 {
+		if err := s.writeUsers(users); err != nil {
+			return err
+		}
+	}
+	logUpgrades(version, changed)
+
+	if err := os.WriteFile(s.versionPath, []byte(strconv.Itoa(dataVersion())+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write data version: %w", err)
+	}
+	return nil
+}
+
+func (s *JSONStore) readUsers() ([]models.User, error) {
+	var users []models.User
+	if err := readJSON(s.usersPath, &users); err != nil {
+		return nil, fmt.Errorf("failed to read users: %w", err)
+	}
+	return users, nil
+}
+
+func (s *JSONStore) writeUsers(users []models.User) error {
+	if err := writeJSON(s.usersPath, users); err != nil {
+		return fmt.Errorf("failed to write users: %w", err)
+	}
+	return nil
+}
+
+func (s *JSONStore) readBlockedIPs() ([]models.BlockedIP, error) {
+	var blockedIPs []models.BlockedIP
+	if err := readJSON(s.blockedIPsPath, &blockedIPs); err != nil {
+		return nil, fmt.Errorf("failed to read blocked IPs: %w", err)
+	}
+	return blockedIPs, nil
+}
+
+func (s *JSONStore) writeBlockedIPs(blockedIPs []models.BlockedIP) error {
+	if err := writeJSON(s.blockedIPsPath, blockedIPs); err != nil {
+		return fmt.Errorf("failed to write blocked IPs: %w", err)
+	}
+	return nil
+}
+
+func (s *JSONStore) readAPIKeys() ([]models.APIKey, error) {
+	var keys []models.APIKey
+	if err := readJSON(s.apiKeysPath, &keys); err != nil {
+		return nil, fmt.Errorf("failed to read API keys: %w", err)
+	}
+	return keys, nil
+}
+
+func (s *JSONStore) writeAPIKeys(keys []models.APIKey) error {
+	if err := writeJSON(s.apiKeysPath, keys); err != nil {
+		return fmt.Errorf("failed to write API keys: %w", err)
+	}
+	return nil
+}
+
+// readJSON decodes the file at path into v. A missing file is treated as empty.
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSON replaces the file at path with v encoded as JSON. It writes a
+// temporary file and renames it, so a crash never leaves a truncated file.
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// migration is one versioned schema change. Migrations declare their own
+// table structs instead of using the models so that a migration keeps
+// producing the same schema when the models change later on.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *gorm.DB) error
+}
+
+// schemaMigration records an applied migration
+type schemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (schemaMigration) TableName() string { return "schema_migrations" }
+
+type v1User struct {
+	Email     string `gorm:"primaryKey;size:255"`
+	Limit     int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (v1User) TableName() string { return "users" }
+
+type v1UserIP struct {
+	Email     string `gorm:"primaryKey;size:255"`
+	IP        string `gorm:"primaryKey;size:45"`
+	CreatedAt time.Time
+}
+
+func (v1UserIP) TableName() string { return "user_ips" }
+
+type v1BlockedIP struct {
+	IP       string `gorm:"primaryKey;size:45"`
+	BanTime  int
+	BannedAt int64
+}
+
+func (v1BlockedIP) TableName() string { return "blocked_ips" }
+
+type v2UserIP struct {
+	Email     string `gorm:"primaryKey;size:255"`
+	IP        string `gorm:"primaryKey;size:45"`
+	FirstSeen time.Time
+	LastSeen  time.Time `gorm:"index"`
+}
+
+func (v2UserIP) TableName() string { return "user_ips" }
+
+type v3User struct {
+	Email          string `gorm:"primaryKey;size:255"`
+	Limit          int
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	DisabledAt     *time.Time
+	DisabledUntil  *time.Time
+	DisabledReason string `gorm:"size:255"`
+}
+
+func (v3User) TableName() string { return "users" }
+
+type v4APIKey struct {
+	ID        string `gorm:"primaryKey;size:32"`
+	Name      string `gorm:"size:255"`
+	Role      string `gorm:"size:32"`
+	Hash      string `gorm:"size:64"`
+	CreatedAt time.Time
+}
+
+func (v4APIKey) TableName() string { return "api_keys" }
+
+type v5User struct {
+	Email string `gorm:"primaryKey;size:255"`
+	Limit *int
+}
+
+func (v5User) TableName() string { return "users" }
+
+type v6User struct {
+	Email         string `gorm:"primaryKey;size:255"`
+	Strikes       int    `gorm:"not null;default:0"`
+	CleanSince    *time.Time
+	StrikeHistory string `gorm:"type:text"`
+}
+
+func (v6User) TableName() string { return "users" }
+
+type v7AuditEntry struct {
+	ID     uint64    `gorm:"primaryKey;autoIncrement"`
+	Time   time.Time `gorm:"index"`
+	Actor  string    `gorm:"size:255;index"`
+	Action string    `gorm:"size:64;index"`
+	Target string    `gorm:"size:255;index"`
+	Reason string    `gorm:"type:text"`
+	Result string    `gorm:"size:16"`
+	Error  string    `gorm:"type:text"`
+	Source string    `gorm:"size:64"`
+}
+
+func (v7AuditEntry) TableName() string { return "audit_log" }
+
+type v8UserIP struct {
+	Email       string `gorm:"primaryKey;size:255"`
+	IP          string `gorm:"primaryKey;size:45"`
+	Country     string `gorm:"size:2"`
+	CountryName string `gorm:"size:255"`
+	City        string `gorm:"size:255"`
+	ASN         uint   `gorm:"column:asn"`
+	ASOrg       string `gorm:"column:as_org;size:255"`
+}
+
+func (v8UserIP) TableName() string { return "user_ips" }
+
+// migrations must only ever be appended to
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create users, user_ips and blocked_ips",
+		up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&v1User{}, &v1UserIP{}, &v1BlockedIP{})
+		},
+	},
+	{
+		version: 2,
+		name:    "track first and last seen time of user IPs",
+		up: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			if err := m.RenameColumn(&v1UserIP{}, "created_at", "first_seen"); err != nil {
+				return err
+			}
+			if err := m.AddColumn(&v2UserIP{}, "LastSeen"); err != nil {
+				return err
+			}
+			if err := tx.Exec("UPDATE user_ips SET last_seen = first_seen").Error; err != nil {
+				return err
+			}
+			return m.CreateIndex(&v2UserIP{}, "LastSeen")
+		},
+	},
+	{
+		version: 3,
+		name:    "record users disabled by Watchdog",
+		up: func(tx *gorm.DB) error {
+			for _, field := range []string{"DisabledAt", "DisabledUntil", "DisabledReason"} {
+				if err := tx.Migrator().AddColumn(&v3User{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version: 4,
+		name:    "create api_keys",
+		up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&v4APIKey{})
+		},
+	},
+	{
+		version: 5,
+		name:    "clear user limits copied from MAX_ALLOW_USERS",
+		up: func(tx *gorm.DB) error {
+			// Until now every user IP overwrote the limit with the global
+			// one, so no stored limit was set on purpose
+			return tx.Model(&v5User{}).Where("1 = 1").Update("limit", nil).Error
+		},
+	},
+	{
+		version: 6,
+		name:    "record user strikes",
+		up: func(tx *gorm.DB) error {
+			for _, field := range []string{"Strikes", "CleanSince", "StrikeHistory"} {
+				if err := tx.Migrator().AddColumn(&v6User{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version: 7,
+		name:    "create audit_log",
+		up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&v7AuditEntry{})
+		},
+	},
+	{
+		version: 8,
+		name:    "record the location of user IPs",
+		up: func(tx *gorm.DB) error {
+			for _, field := range []string{"Country", "CountryName", "City", "ASN", "ASOrg"} {
+				if err := tx.Migrator().AddColumn(&v8UserIP{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// migrate applies every migration newer than the current schema version
+func migrate(db *gorm.DB) error {
+	if err := db.AutoMigrate(&schemaMigration{}); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	var current int
+	if err := db.Model(&schemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&current).Error; err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&schemaMigration{Version: m.version, Name: m.name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		slog.Info("Applied migration", "version", m.version, "name", m.name)
+	}
+	return nil
+}
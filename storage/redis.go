@@ -0,0 +1,527 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+	"watchdog/models"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// redisKeyPrefix starts every key Watchdog writes, keys without it were
+	// written by versions before the Store interface
+	redisKeyPrefix     = "watchdog:"
+	redisUserPrefix    = "watchdog:user:"
+	redisBlockedPrefix = "watchdog:blocked:"
+	redisAPIKeyPrefix  = "watchdog:apikey:"
+	redisAuditKey      = "watchdog:audit"
+	// redisVersionKey holds the version of the stored data, see upgrades
+	redisVersionKey = "watchdog:version"
+)
+
+// RedisStore keeps every user, blocked IP and API key as a JSON value under
+// its own key, and the audit log in a list.
+type RedisStore struct {
+	rdb *redis.Client
+	ctx context.Context
+	// expiration is the TTL of user keys, zero means no expiry
+	expiration time.Duration
+}
+
+// NewRedisStore connects to database db of the Redis server at addr. User
+// keys expire after expiration unless it is zero.
+func NewRedisStore(addr, password string, db int, expiration time.Duration) *RedisStore {
+	return &RedisStore{
+		rdb:        redis.NewClient(&redis.Options{Addr: addr, Password: password, DB: db}),
+		ctx:        context.Background(),
+		expiration: expiration,
+	}
+}
+
+// GetUser retrieves a user by email from Redis
+func (s *RedisStore) GetUser(email string) (*models.User, error) {
+	data, err := s.rdb.Get(s.ctx, redisUserPrefix+email).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("user %s: %w", email, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user from Redis: %w", err)
+	}
+
+	var user models.User
+	if err := json.Unmarshal([]byte(data), &user); err != nil {
+		return nil, fmt.Errorf("failed to deserialize user: %w", err)
+	}
+	return &user, nil
+}
+
+// ListUsers retrieves all users from Redis
+func (s *RedisStore) ListUsers() ([]models.User, error) {
+	values, err := s.scan(redisUserPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users from Redis: %w", err)
+	}
+
+	users := make([]models.User, 0, len(values))
+	for _, data := range values {
+		var user models.User
+		if err := json.Unmarshal([]byte(data), &user); err != nil {
+			return nil, fmt.Errorf("failed to deserialize user: %w", err)
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// AddUser adds or replaces a user in Redis
+func (s *RedisStore) AddUser(user *models.User) error {
+	return s.setUser(user)
+}
+
+// UpsertUserIP adds ip to the user's active IPs, creating the user if needed
+func (s *RedisStore) UpsertUserIP(user *models.User, ip string, geo *models.Geo) error {
+	return s.watchUser(user.Email, func(stored *models.User) (*models.User, error) {
+		now := time.Now()
+		if stored == nil {
+			stored = &models.User{Email: user.Email, Limit: user.Limit, CreatedAt: now}
+		}
+		stored.ActiveIPs = touchIP(stored.ActiveIPs, ip, geo, now)
+		stored.UpdatedAt = now
+		*user = *stored
+		return stored, nil
+	})
+}
+
+// UpdateUser modifies a user in Redis, retrying if the key changes underneath
+func (s *RedisStore) UpdateUser(email string, fn func(user *models.User) error) error {
+	return s.watchUser(email, func(user *models.User) (*models.User, error) {
+		if user == nil {
+			return nil, fmt.Errorf("user %s: %w", email, ErrNotFound)
+		}
+		ips := user.ActiveIPs
+		if err := fn(user); err != nil {
+			return nil, err
+		}
+		user.Email = email
+		user.ActiveIPs = ips
+		return user, nil
+	})
+}
+
+// ClearIPs removes every IP of a user in Redis
+func (s *RedisStore) ClearIPs(email string) error {
+	return s.watchUser(email, func(user *models.User) (*models.User, error) {
+		if user == nil || len(user.ActiveIPs) == 0 {
+			return nil, nil
+		}
+		user.ActiveIPs = []models.ActiveIP{}
+		return user, nil
+	})
+}
+
+// PruneIPs drops IPs last seen before the given time from every user in Redis
+func (s *RedisStore) PruneIPs(before time.Time) (int, error) {
+	users, err := s.ListUsers()
+	if err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	for i := range users {
+		if len(pruneIPs(users[i].ActiveIPs, before)) == len(users[i].ActiveIPs) {
+			continue
+		}
+		// Prune the current record, the user may have been seen again since
+		// it was listed
+		removed := 0
+		err := s.watchUser(users[i].Email, func(user *models.User) (*models.User, error) {
+			removed = 0
+			if user == nil {
+				return nil, nil
+			}
+			count := len(user.ActiveIPs)
+			user.ActiveIPs = pruneIPs(user.ActiveIPs, before)
+			if removed = count - len(user.ActiveIPs); removed == 0 {
+				return nil, nil
+			}
+			return user, nil
+		})
+		if err != nil {
+			return pruned, err
+		}
+		pruned += removed
+	}
+	return pruned, nil
+}
+
+// DeleteUser removes a user from Redis
+func (s *RedisStore) DeleteUser(email string) error {
+	if err := s.rdb.Del(s.ctx, redisUserPrefix+email).Err(); err != nil {
+		return fmt.Errorf("failed to delete user from Redis: %w", err)
+	}
+	return nil
+}
+
+// BlockIP stores a blocked IP in Redis. Temporary bans get a TTL matching
+// their expiry, so Redis drops them even if Watchdog is not running.
+func (s *RedisStore) BlockIP(blocked models.BlockedIP) error {
+	data, err := json.Marshal(blocked)
+	if err != nil {
+		return fmt.Errorf("failed to serialize blocked IP: %w", err)
+	}
+	var ttl time.Duration
+	if !blocked.Permanent() {
+		ttl = time.Until(blocked.ExpiresAt())
+		if ttl <= 0 {
+			return s.UnblockIP(blocked.IP)
+		}
+	}
+	if err := s.rdb.Set(s.ctx, redisBlockedPrefix+blocked.IP, data, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to block IP in Redis: %w", err)
+	}
+	return nil
+}
+
+// UnblockIP removes a blocked IP from Redis
+func (s *RedisStore) UnblockIP(ip string) error {
+	if err := s.rdb.Del(s.ctx, redisBlockedPrefix+ip).Err(); err != nil {
+		return fmt.Errorf("failed to unblock IP in Redis: %w", err)
+	}
+	return nil
+}
+
+// ListBlockedIPs retrieves all blocked IPs from Redis
+func (s *RedisStore) ListBlockedIPs() ([]models.BlockedIP, error) {
+	values, err := s.scan(redisBlockedPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blocked IPs from Redis: %w", err)
+	}
+
+	blockedIPs := make([]models.BlockedIP, 0, len(values))
+	for _, data := range values {
+		var blocked models.BlockedIP
+		if err := json.Unmarshal([]byte(data), &blocked); err != nil {
+			return nil, fmt.Errorf("failed to deserialize blocked IP: %w", err)
+		}
+		blockedIPs = append(blockedIPs, blocked)
+	}
+	return blockedIPs, nil
+}
+
+// AddAPIKey stores an API key in Redis
+func (s *RedisStore) AddAPIKey(key models.APIKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Errorf("failed to serialize API key: %w", err)
+	}
+	if err := s.rdb.Set(s.ctx, redisAPIKeyPrefix+key.ID, data, 0).Err(); err != nil {
+		return fmt.Errorf("failed to add API key to Redis: %w", err)
+	}
+	return nil
+}
+
+// GetAPIKey retrieves an API key by ID from Redis
+func (s *RedisStore) GetAPIKey(id string) (*models.APIKey, error) {
+	data, err := s.rdb.Get(s.ctx, redisAPIKeyPrefix+id).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("API key %s: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API key from Redis: %w", err)
+	}
+
+	var key models.APIKey
+	if err := json.Unmarshal([]byte(data), &key); err != nil {
+		return nil, fmt.Errorf("failed to deserialize API key: %w", err)
+	}
+	return &key, nil
+}
+
+// ListAPIKeys retrieves all API keys from Redis
+func (s *RedisStore) ListAPIKeys() ([]models.APIKey, error) {
+	values, err := s.scan(redisAPIKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys from Redis: %w", err)
+	}
+
+	keys := make([]models.APIKey, 0, len(values))
+	for _, data := range values {
+		var key models.APIKey
+		if err := json.Unmarshal([]byte(data), &key); err != nil {
+			return nil, fmt.Errorf("failed to deserialize API key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// DeleteAPIKey removes an API key from Redis
+func (s *RedisStore) DeleteAPIKey(id string) error {
+	if err := s.rdb.Del(s.ctx, redisAPIKeyPrefix+id).Err(); err != nil {
+		return fmt.Errorf("failed to delete API key from Redis: %w", err)
+	}
+	return nil
+}
+
+// AppendAudit pushes an entry onto the audit log list in Redis
+func (s *RedisStore) AppendAudit(entry models.AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to serialize audit entry: %w", err)
+	}
+	if err := s.rdb.RPush(s.ctx, redisAuditKey, data).Err(); err != nil {
+		return fmt.Errorf("failed to append audit entry to Redis: %w", err)
+	}
+	return nil
+}
+
+// ListAudit reads the audit log list in Redis from the newest entry, until
+// filter.Limit entries are selected
+func (s *RedisStore) ListAudit(filter AuditFilter) ([]models.AuditEntry, error) {
+	const page = 500
+	var entries []models.AuditEntry
+	for end := int64(-1); ; end -= page {
+		values, err := s.rdb.LRange(s.ctx, redisAuditKey, end-page+1, end).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit log from Redis: %w", err)
+		}
+		for i := len(values) - 1; i >= 0; i-- {
+			var entry models.AuditEntry
+			if err := json.Unmarshal([]byte(values[i]), &entry); err != nil {
+				return nil, fmt.Errorf("failed to deserialize audit entry: %w", err)
+			}
+			if !filter.match(&entry) {
+				continue
+			}
+			entries = append(entries, entry)
+			if filter.full(entries) {
+				return entries, nil
+			}
+		}
+		if len(values) < page {
+			return entries, nil
+		}
+	}
+}
+
+// Upgrade applies the upgrades the stored users have not had yet
+func (s *RedisStore) Upgrade() error {
+	version, err := s.rdb.Get(s.ctx, redisVersionKey).Int()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to read data version from Redis: %w", err)
+	}
+	if version >= dataVersion() {
+		return nil
+	}
+
+	var emails []string
+	iter := s.rdb.Scan(s.ctx, 0, redisUserPrefix+"*", 100).Iterator()
+	for iter.Next(s.ctx) {
+		emails = append(emails, strings.TrimPrefix(iter.Val(), redisUserPrefix))
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("failed to list users from Redis: %w", err)
+	}
+	changed := 0
+	for _, email := range emails {
+		upgraded := false
+		err := s.watchUser(email, func(user *models.User) (*models.User, error) {
+			upgraded = user != nil && upgradeUser(user, version)
+			if !upgraded {
+				return nil, nil
+			}
+			return user, nil
+		})
+		if err != nil {
+			return err
+		}
+		if upgraded {
+			changed++
+		}
+	}
+	logUpgrades(version, changed)
+
+	// Data from before the versioning may still use the legacy keys
+	if version == 0 {
+		if err := s.migrateLegacyKeys(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.rdb.Set(s.ctx, redisVersionKey, dataVersion(), 0).Err(); err != nil {
+		return fmt.Errorf("failed to write data version to Redis: %w", err)
+	}
+	return nil
+}
+
+// migrateLegacyKeys moves the users and blocked IPs stored under the keys of
+// versions before the Store interface to their current keys, and deletes the
+// legacy keys. A user that already has a current record keeps it.
+func (s *RedisStore) migrateLegacyKeys() error {
+	var keys []string
+	iter := s.rdb.ScanType(s.ctx, 0, "*", 100, "string").Iterator()
+	for iter.Next(s.ctx) {
+		if !strings.HasPrefix(iter.Val(), redisKeyPrefix) {
+			keys = append(keys, iter.Val())
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("failed to list legacy keys from Redis: %w", err)
+	}
+
+	now := time.Now()
+	users, blockedIPs := 0, 0
+	for _, key := range keys {
+		data, err := s.rdb.Get(s.ctx, key).Result()
+		if err == redis.Nil {
+			continue // expired between SCAN and GET
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get legacy key from Redis: %w", err)
+		}
+
+		user, blocked := legacyRecord(key, data, now)
+		switch {
+		case user != nil:
+			err = s.watchUser(user.Email, func(current *models.User) (*models.User, error) {
+				if current != nil {
+					return nil, nil
+				}
+				return user, nil
+			})
+			users++
+		case blocked != nil:
+			err = s.BlockIP(*blocked)
+			blockedIPs++
+		default:
+			continue // not written by Watchdog
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.rdb.Del(s.ctx, key).Err(); err != nil {
+			return fmt.Errorf("failed to delete legacy key from Redis: %w", err)
+		}
+	}
+	if users > 0 || blockedIPs > 0 {
+		slog.Info("Migrated legacy Redis keys", "users", users, "blocked_ips", blockedIPs)
+	}
+	return nil
+}
+
+// legacyRecord decodes the value of a legacy key. Users were stored under
+// their email, as JSON or, when added through the API, as their limit. Only
+// the latter was set on purpose, the JSON records get every upgrade.
+// Blocked IPs were stored under the IP as their ban time in minutes, without
+// the time of the ban, so their ban starts now. It returns nil for both when
+// the key is not one of these.
+func legacyRecord(key, value string, now time.Time) (*models.User, *models.BlockedIP) {
+	if n, err := strconv.Atoi(value); err == nil {
+		if _, err := netip.ParseAddr(key); err == nil {
+			return nil, &models.BlockedIP{IP: key, BanTime: n, BannedAt: now.Unix()}
+		}
+		return &models.User{Email: key, Limit: &n, CreatedAt: now, UpdatedAt: now}, nil
+	}
+
+	var user models.User
+	if err := json.Unmarshal([]byte(value), &user); err != nil || user.Email != key {
+		return nil, nil
+	}
+	upgradeUser(&user, 0)
+	return &user, nil
+}
+
+// Close closes the connections to Redis
+func (s *RedisStore) Close() error {
+	if err := s.rdb.Close(); err != nil {
+		return fmt.Errorf("failed to close Redis client: %w", err)
+	}
+	return nil
+}
+
+func (s *RedisStore) setUser(user *models.User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return fmt.Errorf("failed to serialize user: %w", err)
+	}
+	if err := s.rdb.Set(s.ctx, redisUserPrefix+user.Email, data, s.userTTL(user)).Err(); err != nil {
+		return fmt.Errorf("failed to add/update user in Redis: %w", err)
+	}
+	return nil
+}
+
+// userTTL returns the TTL of the user's key. Disabled users do not expire,
+// otherwise Watchdog would forget to re-enable them.
+func (s *RedisStore) userTTL(user *models.User) time.Duration {
+	if user.Disabled() {
+		return 0
+	}
+	return s.expiration
+}
+
+// watchUser applies fn to the user stored under email and writes back the
+// record fn returns, retrying if the key changes underneath. fn receives nil
+// when the user does not exist and returns nil to leave the key alone; it may
+// run several times.
+func (s *RedisStore) watchUser(email string, fn func(user *models.User) (*models.User, error)) error {
+	key := redisUserPrefix + email
+	update := func(tx *redis.Tx) error {
+		var current *models.User
+		data, err := tx.Get(s.ctx, key).Result()
+		switch {
+		case err == redis.Nil:
+		case err != nil:
+			return fmt.Errorf("failed to get user from Redis: %w", err)
+		default:
+			current = &models.User{}
+			if err := json.Unmarshal([]byte(data), current); err != nil {
+				return fmt.Errorf("failed to deserialize user: %w", err)
+			}
+		}
+
+		updated, err := fn(current)
+		if err != nil || updated == nil {
+			return err
+		}
+		value, err := json.Marshal(updated)
+		if err != nil {
+			return fmt.Errorf("failed to serialize user: %w", err)
+		}
+		_, err = tx.TxPipelined(s.ctx, func(pipe redis.Pipeliner) error {
+			return pipe.Set(s.ctx, key, value, s.userTTL(updated)).Err()
+		})
+		return err
+	}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		err := s.rdb.Watch(s.ctx, update, key)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return fmt.Errorf("failed to update user %s in Redis: too much contention", email)
+}
+
+// scan returns the values of every key starting with prefix.
+func (s *RedisStore) scan(prefix string) ([]string, error) {
+	var values []string
+	iter := s.rdb.Scan(s.ctx, 0, prefix+"*", 100).Iterator()
+	for iter.Next(s.ctx) {
+		data, err := s.rdb.Get(s.ctx, iter.Val()).Result()
+		if err == redis.Nil {
+			continue // expired between SCAN and GET
+		}
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, data)
+	}
+	return values, iter.Err()
+}
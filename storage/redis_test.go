@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLegacyRecord(t *testing.T) {
+	now := time.Now()
+	four := 4
+	tests := []struct {
+		name  string
+		key   string
+		value string
+		// user is the email and limit of the expected user, blocked the IP
+		// and ban time of the expected ban
+		user    string
+		limit   *int
+		ips     []string
+		blocked string
+		banTime int
+	}{
+		// The limit of a JSON record is a copy of the global one
+		{name: "user", key: "12.alice", value: `{"email":"12.alice","limit":2,"active_ips":["1.2.3.4","5.6.7.8"]}`, user: "12.alice", ips: []string{"1.2.3.4", "5.6.7.8"}},
+		{name: "user limit", key: "3.bob", value: "4", user: "3.bob", limit: &four},
+		{name: "blocked IPv4", key: "1.2.3.4", value: "5", blocked: "1.2.3.4", banTime: 5},
+		{name: "blocked IPv6", key: "2001:db8::1", value: "5", blocked: "2001:db8::1", banTime: 5},
+		{name: "user under another key", key: "3.bob", value: `{"email":"12.alice","limit":2}`},
+		{name: "other data", key: "session", value: "abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, blocked := legacyRecord(tt.key, tt.value, now)
+
+			switch {
+			case tt.user == "" && user != nil:
+				t.Errorf("user = %+v, want none", user)
+			case tt.user != "" && user == nil:
+				t.Errorf("user = nil, want %s", tt.user)
+			case user != nil:
+				if user.Email != tt.user || (user.Limit == nil) != (tt.limit == nil) || (user.Limit != nil && *user.Limit != *tt.limit) {
+					t.Errorf("user = %s with limit %v, want %s with limit %v", user.Email, user.Limit, tt.user, tt.limit)
+				}
+				if len(user.ActiveIPs) != len(tt.ips) {
+					t.Fatalf("ActiveIPs = %+v, want %v", user.ActiveIPs, tt.ips)
+				}
+				for i, ip := range user.ActiveIPs {
+					if ip.IP != tt.ips[i] {
+						t.Errorf("ActiveIPs[%d] = %s, want %s", i, ip.IP, tt.ips[i])
+					}
+				}
+			}
+
+			switch {
+			case tt.blocked == "" && blocked != nil:
+				t.Errorf("blocked = %+v, want none", blocked)
+			case tt.blocked != "" && blocked == nil:
+				t.Errorf("blocked = nil, want %s", tt.blocked)
+			case blocked != nil:
+				if blocked.IP != tt.blocked || blocked.BanTime != tt.banTime || blocked.BannedAt != now.Unix() {
+					t.Errorf("blocked = %+v, want %s for %d minutes from now", blocked, tt.blocked, tt.banTime)
+				}
+			}
+		})
+	}
+}
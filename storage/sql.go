@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"watchdog/models"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+)
+
+// PoolConfig holds the connection pool settings of a SQL database.
+// Zero values leave the database/sql defaults in place.
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// SQLStore keeps users, their IPs and blocked IPs in a SQL database through
+// gorm. It backs the sqlite, postgres and mysql storage types, which share
+// the same schema and migrations.
+type SQLStore struct {
+	db      *gorm.DB
+	dialect string
+}
+
+// NewSQLStore opens a database with the given gorm dialector, applies the
+// pool settings and brings the schema up to date.
+func NewSQLStore(dialector gorm.Dialector, pool PoolConfig) (*SQLStore, error) {
+	dialect := dialector.Name()
+	db, err := gorm.Open(dialector, &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s database: %w", dialect, err)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	if pool.MaxOpenConns > 0 {
+		sqlDB.SetMaxOpenConns(pool.MaxOpenConns)
+	}
+	if pool.MaxIdleConns > 0 {
+		sqlDB.SetMaxIdleConns(pool.MaxIdleConns)
+	}
+	if pool.ConnMaxLifetime > 0 {
+		sqlDB.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	}
+
+	if err := migrate(db); err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+	return &SQLStore{db: db, dialect: dialect}, nil
+}
+
+// NewPostgresStore connects to PostgreSQL using dsn
+func NewPostgresStore(dsn string, pool PoolConfig) (*SQLStore, error) {
+	return NewSQLStore(postgres.Open(dsn), pool)
+}
+
+// NewMySQLStore connects to MySQL using dsn. The DSN must set parseTime=true
+// so that timestamps can be scanned.
+func NewMySQLStore(dsn string, pool PoolConfig) (*SQLStore, error) {
+	return NewSQLStore(mysql.Open(dsn), pool)
+}
+
+// GetUser retrieves a user and its IPs by email from the database
+func (s *SQLStore) GetUser(email string) (*models.User, error) {
+	var user models.User
+	err := s.db.Where("email = ?", email).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("user %s: %w", email, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user from %s: %w", s.dialect, err)
+	}
+
+	var ips []models.UserIP
+	if err := s.db.Where("email = ?", email).Order("first_seen").Find(&ips).Error; err != nil {
+		return nil, fmt.Errorf("failed to get user IPs from %s: %w", s.dialect, err)
+	}
+	user.ActiveIPs = activeIPs(ips)
+	return &user, nil
+}
+
+// ListUsers retrieves all users and their IPs from the database
+func (s *SQLStore) ListUsers() ([]models.User, error) {
+	var users []models.User
+	if err := s.db.Order("email").Find(&users).Error; err != nil {
+		return nil, fmt.Errorf("failed to read users from %s: %w", s.dialect, err)
+	}
+
+	var ips []models.UserIP
+	if err := s.db.Order("first_seen").Find(&ips).Error; err != nil {
+		return nil, fmt.Errorf("failed to read user IPs from %s: %w", s.dialect, err)
+	}
+	byEmail := make(map[string][]models.UserIP, len(users))
+	for _, ip := range ips {
+		byEmail[ip.Email] = append(byEmail[ip.Email], ip)
+	}
+	for i := range users {
+		users[i].ActiveIPs = activeIPs(byEmail[users[i].Email])
+	}
+	return users, nil
+}
+
+// AddUser adds or replaces a user and its IPs in the database
+func (s *SQLStore) AddUser(user *models.User) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(user).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("email = ?", user.Email).Delete(&models.UserIP{}).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, ip := range user.ActiveIPs {
+			row := models.NewUserIP(user.Email, ip)
+			if row.FirstSeen.IsZero() {
+				row.FirstSeen = now
+			}
+			if row.LastSeen.IsZero() {
+				row.LastSeen = now
+			}
+			if err := tx.Create(&row).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add user to %s: %w", s.dialect, err)
+	}
+	return nil
+}
+
+// UpsertUserIP adds ip to the user's active IPs, creating the user if needed
+func (s *SQLStore) UpsertUserIP(user *models.User, ip string, geo *models.Geo) error {
+	now := time.Now()
+	row := models.NewUserIP(user.Email, models.ActiveIP{IP: ip, FirstSeen: now, LastSeen: now, Geo: geo})
+	updates := clause.AssignmentColumns([]string{"last_seen"})
+	if geo != nil {
+		updates = clause.AssignmentColumns([]string{"last_seen", "country", "country_name", "city", "asn", "as_org"})
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "email"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{"updated_at": now}),
+		}).Create(&models.User{Email: user.Email, Limit: user.Limit, CreatedAt: now, UpdatedAt: now}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "email"}, {Name: "ip"}},
+			DoUpdates: updates,
+		}).Create(&row).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upsert user in %s: %w", s.dialect, err)
+	}
+
+	stored, err := s.GetUser(user.Email)
+	if err != nil {
+		return err
+	}
+	*user = *stored
+	return nil
+}
+
+// UpdateUser modifies a user inside a transaction holding its row lock
+func (s *SQLStore) UpdateUser(email string, fn func(user *models.User) error) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("email = ?", email).First(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("user %s: %w", email, ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(&user); err != nil {
+			return err
+		}
+		user.Email = email
+		return tx.Save(&user).Error
+	})
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to update user in %s: %w", s.dialect, err)
+	}
+	return err
+}
+
+// ClearIPs deletes every IP of a user
+func (s *SQLStore) ClearIPs(email string) error {
+	if err := s.db.Where("email = ?", email).Delete(&models.UserIP{}).Error; err != nil {
+		return fmt.Errorf("failed to clear user IPs in %s: %w", s.dialect, err)
+	}
+	return nil
+}
+
+// PruneIPs deletes user IPs last seen before the given time
+func (s *SQLStore) PruneIPs(before time.Time) (int, error) {
+	result := s.db.Where("last_seen < ?", before).Delete(&models.UserIP{})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to prune user IPs in %s: %w", s.dialect, result.Error)
+	}
+	return int(result.RowsAffected), nil
+}
+
+// DeleteUser removes a user and its IPs from the database
+func (s *SQLStore) DeleteUser(email string) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("email = ?", email).Delete(&models.UserIP{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("email = ?", email).Delete(&models.User{}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete user from %s: %w", s.dialect, err)
+	}
+	return nil
+}
+
+// BlockIP stores a blocked IP in the database
+func (s *SQLStore) BlockIP(blocked models.BlockedIP) error {
+	if err := s.db.Save(&blocked).Error; err != nil {
+		return fmt.Errorf("failed to block IP in %s: %w", s.dialect, err)
+	}
+	return nil
+}
+
+// UnblockIP removes a blocked IP from the database
+func (s *SQLStore) UnblockIP(ip string) error {
+	if err := s.db.Where("ip = ?", ip).Delete(&models.BlockedIP{}).Error; err != nil {
+		return fmt.Errorf("failed to unblock IP in %s: %w", s.dialect, err)
+	}
+	return nil
+}
+
+// ListBlockedIPs retrieves all blocked IPs from the database
+func (s *SQLStore) ListBlockedIPs() ([]models.BlockedIP, error) {
+	var blockedIPs []models.BlockedIP
+	if err := s.db.Order("banned_at").Find(&blockedIPs).Error; err != nil {
+		return nil, fmt.Errorf("failed to read blocked IPs from %s: %w", s.dialect, err)
+	}
+	return blockedIPs, nil
+}
+
+// AddAPIKey stores an API key in the database
+func (s *SQLStore) AddAPIKey(key models.APIKey) error {
+	if err := s.db.Create(&key).Error; err != nil {
+		return fmt.Errorf("failed to add API key to %s: %w", s.dialect, err)
+	}
+	return nil
+}
+
+// GetAPIKey retrieves an API key by ID from the database
+func (s *SQLStore) GetAPIKey(id string) (*models.APIKey, error) {
+	var key models.APIKey
+	err := s.db.Where("id = ?", id).First(&key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("API key %s: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API key from %s: %w", s.dialect, err)
+	}
+	return &key, nil
+}
+
+// ListAPIKeys retrieves all API keys from the database
+func (s *SQLStore) ListAPIKeys() ([]models.APIKey, error) {
+	var keys []models.APIKey
+	if err := s.db.Order("created_at").Find(&keys).Error; err != nil {
+		return nil, fmt.Errorf("failed to read API keys from %s: %w", s.dialect, err)
+	}
+	return keys, nil
+}
+
+// DeleteAPIKey removes an API key from the database
+func (s *SQLStore) DeleteAPIKey(id string) error {
+	if err := s.db.Where("id = ?", id).Delete(&models.APIKey{}).Error; err != nil {
+		return fmt.Errorf("failed to delete API key from %s: %w", s.dialect, err)
+	}
+	return nil
+}
+
+// AppendAudit inserts an entry into the audit log table
+func (s *SQLStore) AppendAudit(entry models.AuditEntry) error {
+	if err := s.db.Create(&entry).Error; err != nil {
+		return fmt.Errorf("failed to append audit entry to %s: %w", s.dialect, err)
+	}
+	return nil
+}
+
+// ListAudit queries the audit log table
+func (s *SQLStore) ListAudit(filter AuditFilter) ([]models.AuditEntry, error) {
+	query := s.db.Order("time DESC, id DESC")
+	if filter.Actor != "" {
+		query = query.Where("actor = ?", filter.Actor)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.Target != "" {
+		query = query.Where("target = ?", filter.Target)
+	}
+	// Entries are written in UTC and SQLite compares times as text, so the
+	// bounds must be in UTC as well
+	if !filter.Since.IsZero() {
+		query = query.Where("time >= ?", filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("time <= ?", filter.Until.UTC())
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+
+	var entries []models.AuditEntry
+	if err := query.Find(&entries).Error; err != nil {
+		return nil, fmt.Errorf("failed to read audit log from %s: %w", s.dialect, err)
+	}
+	return entries, nil
+}
+
+// Close waits for running queries and closes the database connections
+func (s *SQLStore) Close() error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	if err := sqlDB.Close(); err != nil {
+		return fmt.Errorf("failed to close %s database: %w", s.dialect, err)
+	}
+	return nil
+}
+
+// activeIPs converts user_ips rows to the IPs of a models.User
+func activeIPs(rows []models.UserIP) []models.ActiveIP {
+	ips := make([]models.ActiveIP, 0, len(rows))
+	for _, row := range rows {
+		ips = append(ips, row.ActiveIP())
+	}
+	return ips
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"watchdog/config"
+
+	"github.com/glebarez/sqlite"
+)
+
+func TestNewSQLStorePool(t *testing.T) {
+	tests := []struct {
+		name    string
+		pool    PoolConfig
+		maxOpen int
+	}{
+		{"defaults", PoolConfig{}, 0},
+		{"limits", PoolConfig{MaxOpenConns: 4, MaxIdleConns: 2, ConnMaxLifetime: time.Minute}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := NewSQLStore(sqlite.Open(filepath.Join(t.TempDir(), "watchdog.db")), tt.pool)
+			if err != nil {
+				t.Fatalf("NewSQLStore() error = %v", err)
+			}
+			sqlDB, err := store.db.DB()
+			if err != nil {
+				t.Fatalf("DB() error = %v", err)
+			}
+			defer sqlDB.Close()
+
+			if store.dialect != "sqlite" {
+				t.Errorf("dialect = %q, want sqlite", store.dialect)
+			}
+			if got := sqlDB.Stats().MaxOpenConnections; got != tt.maxOpen {
+				t.Errorf("MaxOpenConnections = %d, want %d", got, tt.maxOpen)
+			}
+			// The schema is migrated
+			if !store.db.Migrator().HasTable("user_ips") {
+				t.Error("user_ips table is missing")
+			}
+		})
+	}
+}
+
+func TestNewSQLDrivers(t *testing.T) {
+	tests := []struct {
+		cfg config.Storage
+		// err is part of the expected error
+		err string
+	}{
+		// Nothing listens on port 1, so opening fails after the driver was chosen
+		{config.Storage{Type: "postgres", DSN: "host=127.0.0.1 port=1 user=watchdog dbname=watchdog sslmode=disable connect_timeout=2"}, "failed to open postgres database"},
+		{config.Storage{Type: "mysql", DSN: "watchdog:secret@tcp(127.0.0.1:1)/watchdog?parseTime=true&timeout=2s"}, "failed to open mysql database"},
+		{config.Storage{Type: "oracle"}, "invalid storage type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cfg.Type, func(t *testing.T) {
+			store, err := New(tt.cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("New(%q) = %v, %v, want an error containing %q", tt.cfg.Type, store, err, tt.err)
+			}
+			if store != nil {
+				t.Errorf("New(%q) returned a store with the error", tt.cfg.Type)
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/glebarez/sqlite"
+)
+
+// NewSQLiteStore opens (or creates) the SQLite database at path and brings
+// its schema up to date.
+func NewSQLiteStore(path string) (*SQLStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create SQLite directory: %w", err)
+	}
+
+	// WAL lets the sweeper read while the ingest path writes, and busy_timeout
+	// makes concurrent writers wait instead of failing with SQLITE_BUSY.
+	dsn := path + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+
+	// SQLite allows a single writer, so serialize access through one connection
+	return NewSQLStore(sqlite.Open(dsn), PoolConfig{MaxOpenConns: 1})
+}
@@ -0,0 +1,149 @@
+// Package storage provides the persistence backends used by Watchdog.
+//
+// Every backend implements Store, so the WebSocket ingest path, the user
+// sweeper and the HTTP API do not need to know which one is configured.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"watchdog/config"
+	"watchdog/models"
+)
+
+// ErrNotFound is returned when a user, blocked IP or API key does not exist.
+var ErrNotFound = errors.New("not found")
+
+// Store is implemented by every storage backend.
+type Store interface {
+	// GetUser returns the user with the given email or ErrNotFound.
+	GetUser(email string) (*models.User, error)
+	// ListUsers returns every stored user.
+	ListUsers() ([]models.User, error)
+	// AddUser creates the user or replaces an existing one with the same email.
+	AddUser(user *models.User) error
+	// UpsertUserIP records ip as an active IP of user, creating the user if
+	// needed, and refreshes the IP's last-seen time and, when geo is not nil,
+	// its location. The limit of an existing user is kept. On success user
+	// holds the stored record.
+	UpsertUserIP(user *models.User, ip string, geo *models.Geo) error
+	// UpdateUser applies fn to the stored user with the given email and saves
+	// the result atomically. It returns ErrNotFound if the user does not
+	// exist. ActiveIPs are managed by UpsertUserIP, PruneIPs and ClearIPs, so
+	// changes fn makes to them are not saved.
+	UpdateUser(email string, fn func(user *models.User) error) error
+	// ClearIPs removes every active IP of the user with the given email.
+	ClearIPs(email string) error
+	// PruneIPs removes every user IP that was last seen before the given time
+	// and returns how many were removed.
+	PruneIPs(before time.Time) (int, error)
+	// DeleteUser removes the user with the given email.
+	DeleteUser(email string) error
+
+	// BlockIP stores a blocked IP, replacing an existing entry for the same IP.
+	BlockIP(blocked models.BlockedIP) error
+	// UnblockIP removes the blocked IP entry for ip.
+	UnblockIP(ip string) error
+	// ListBlockedIPs returns every blocked IP.
+	ListBlockedIPs() ([]models.BlockedIP, error)
+
+	// AddAPIKey stores a new API key.
+	AddAPIKey(key models.APIKey) error
+	// GetAPIKey returns the API key with the given ID or ErrNotFound.
+	GetAPIKey(id string) (*models.APIKey, error)
+	// ListAPIKeys returns every API key.
+	ListAPIKeys() ([]models.APIKey, error)
+	// DeleteAPIKey removes the API key with the given ID.
+	DeleteAPIKey(id string) error
+
+	// AppendAudit adds an entry to the audit log. Entries are never changed
+	// or removed.
+	AppendAudit(entry models.AuditEntry) error
+	// ListAudit returns the audit entries selected by filter, newest first.
+	ListAudit(filter AuditFilter) ([]models.AuditEntry, error)
+
+	// Close releases the backend's files or connections once running
+	// operations are done. The store must not be used afterwards.
+	Close() error
+}
+
+// New returns the Store selected by cfg.Type ("json", "redis", "sqlite",
+// "postgres" or "mysql"), instrumented with metrics.
+func New(cfg config.Storage) (Store, error) {
+	store, err := newStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return Instrument(store, cfg.Type), nil
+}
+
+func newStore(cfg config.Storage) (Store, error) {
+	switch cfg.Type {
+	case "json":
+		store := NewJSONStore("storage/users.json", "storage/blocked_ips.json", "storage/api_keys.json", "storage/audit.jsonl")
+		if err := store.Upgrade(); err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "redis":
+		store := NewRedisStore(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB, cfg.Expiration)
+		if err := store.Upgrade(); err != nil {
+			store.Close()
+			return nil, err
+		}
+		return store, nil
+	case "sqlite":
+		return sqlStore(NewSQLiteStore(cfg.SQLitePath))
+	case "postgres", "mysql":
+		pool := PoolConfig{
+			MaxOpenConns:    cfg.MaxOpenConns,
+			MaxIdleConns:    cfg.MaxIdleConns,
+			ConnMaxLifetime: cfg.ConnMaxLifetime,
+		}
+		if cfg.Type == "postgres" {
+			return sqlStore(NewPostgresStore(cfg.DSN, pool))
+		}
+		return sqlStore(NewMySQLStore(cfg.DSN, pool))
+	default:
+		return nil, fmt.Errorf("invalid storage type %q, must be 'redis', 'json', 'sqlite', 'postgres' or 'mysql'", cfg.Type)
+	}
+}
+
+// sqlStore converts the result of a SQL constructor without turning a nil
+// *SQLStore into a non-nil Store.
+func sqlStore(store *SQLStore, err error) (Store, error) {
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// touchIP marks ip as seen at now, adding it to ips if it is new. A geo that
+// is not nil replaces the IP's location.
+func touchIP(ips []models.ActiveIP, ip string, geo *models.Geo, now time.Time) []models.ActiveIP {
+	for i := range ips {
+		if ips[i].IP == ip {
+			if ips[i].FirstSeen.IsZero() {
+				ips[i].FirstSeen = now // stored before timestamps were tracked
+			}
+			ips[i].LastSeen = now
+			if geo != nil {
+				ips[i].Geo = geo
+			}
+			return ips
+		}
+	}
+	return append(ips, models.ActiveIP{IP: ip, FirstSeen: now, LastSeen: now, Geo: geo})
+}
+
+// pruneIPs returns the IPs in ips that were seen at or after the given time.
+func pruneIPs(ips []models.ActiveIP, before time.Time) []models.ActiveIP {
+	kept := ips[:0]
+	for _, ip := range ips {
+		if !ip.LastSeen.Before(before) {
+			kept = append(kept, ip)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,243 @@
+package storage_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+	"watchdog/models"
+	"watchdog/storage"
+	"watchdog/storage/storagetest"
+)
+
+// testStores returns the backends that run without a server
+func testStores(t *testing.T) map[string]storage.Store {
+	return map[string]storage.Store{
+		"json":   storagetest.NewJSONStore(t),
+		"sqlite": storagetest.NewSQLiteStore(t),
+	}
+}
+
+func getUser(t *testing.T, store storage.Store, email string) *models.User {
+	t.Helper()
+	user, err := store.GetUser(email)
+	if err != nil {
+		t.Fatalf("GetUser() error = %v", err)
+	}
+	return user
+}
+
+func TestUpsertUserIP(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			limit := 2
+			geo := &models.Geo{Country: "DE", CountryName: "Germany", City: "Berlin", ASN: 3320, ASOrg: "Deutsche Telekom AG"}
+			if err := store.UpsertUserIP(&models.User{Email: "12.alice", Limit: &limit}, "1.2.3.4", geo); err != nil {
+				t.Fatalf("UpsertUserIP() error = %v", err)
+			}
+			first := getUser(t, store, "12.alice").ActiveIPs
+			if len(first) != 1 || first[0].IP != "1.2.3.4" || first[0].FirstSeen.IsZero() {
+				t.Fatalf("ActiveIPs = %+v, want 1.2.3.4 with its first-seen time", first)
+			}
+
+			// The limit of an existing user and the location of a known IP are
+			// kept
+			time.Sleep(10 * time.Millisecond)
+			if err := store.UpsertUserIP(&models.User{Email: "12.alice"}, "1.2.3.4", nil); err != nil {
+				t.Fatalf("UpsertUserIP() error = %v", err)
+			}
+			if err := store.UpsertUserIP(&models.User{Email: "12.alice"}, "5.6.7.8", nil); err != nil {
+				t.Fatalf("UpsertUserIP() error = %v", err)
+			}
+			user := getUser(t, store, "12.alice")
+			if user.Limit == nil || *user.Limit != 2 {
+				t.Errorf("Limit = %v, want 2", user.Limit)
+			}
+			if len(user.ActiveIPs) != 2 {
+				t.Fatalf("ActiveIPs = %+v, want 2 IPs", user.ActiveIPs)
+			}
+			for _, ip := range user.ActiveIPs {
+				if ip.IP != "1.2.3.4" {
+					if ip.Geo != nil {
+						t.Errorf("Geo of %s = %+v, want none", ip.IP, ip.Geo)
+					}
+					continue
+				}
+				if !ip.FirstSeen.Equal(first[0].FirstSeen) || !ip.LastSeen.After(first[0].LastSeen) {
+					t.Errorf("seen %v to %v, want the first-seen time kept and the last-seen time refreshed", ip.FirstSeen, ip.LastSeen)
+				}
+				if ip.Geo == nil || *ip.Geo != *geo {
+					t.Errorf("Geo = %+v, want %+v", ip.Geo, geo)
+				}
+			}
+		})
+	}
+}
+
+func TestPruneIPs(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, ip := range []string{"1.2.3.4", "5.6.7.8"} {
+				if err := store.UpsertUserIP(&models.User{Email: "3.bob"}, ip, nil); err != nil {
+					t.Fatalf("UpsertUserIP() error = %v", err)
+				}
+			}
+
+			// Both IPs were seen just now
+			if pruned, err := store.PruneIPs(time.Now().Add(-time.Minute)); err != nil || pruned != 0 {
+				t.Errorf("PruneIPs(past) = %d, %v, want 0", pruned, err)
+			}
+			if pruned, err := store.PruneIPs(time.Now().Add(time.Minute)); err != nil || pruned != 2 {
+				t.Errorf("PruneIPs(future) = %d, %v, want 2", pruned, err)
+			}
+			if ips := getUser(t, store, "3.bob").ActiveIPs; len(ips) != 0 {
+				t.Errorf("ActiveIPs = %+v, want none after pruning", ips)
+			}
+		})
+	}
+}
+
+func TestClearIPs(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, email := range []string{"12.alice", "3.bob"} {
+				if err := store.UpsertUserIP(&models.User{Email: email}, "1.2.3.4", nil); err != nil {
+					t.Fatalf("UpsertUserIP() error = %v", err)
+				}
+			}
+
+			if err := store.ClearIPs("12.alice"); err != nil {
+				t.Fatalf("ClearIPs() error = %v", err)
+			}
+			if ips := getUser(t, store, "12.alice").ActiveIPs; len(ips) != 0 {
+				t.Errorf("ActiveIPs = %+v, want none", ips)
+			}
+			if ips := getUser(t, store, "3.bob").ActiveIPs; len(ips) != 1 {
+				t.Errorf("ActiveIPs of another user = %+v, want the IP to be kept", ips)
+			}
+			if err := store.ClearIPs("1.nobody"); err != nil {
+				t.Errorf("ClearIPs(missing) error = %v", err)
+			}
+		})
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			err := store.UpdateUser("1.nobody", func(user *models.User) error { return nil })
+			if !errors.Is(err, storage.ErrNotFound) {
+				t.Fatalf("UpdateUser(missing) error = %v, want ErrNotFound", err)
+			}
+
+			if err := store.UpsertUserIP(&models.User{Email: "3.bob"}, "1.2.3.4", nil); err != nil {
+				t.Fatalf("UpsertUserIP() error = %v", err)
+			}
+			now := time.Now().Truncate(time.Second)
+			until := now.Add(time.Hour)
+			err = store.UpdateUser("3.bob", func(user *models.User) error {
+				user.DisabledAt, user.DisabledUntil = &now, &until
+				user.DisabledReason = "connected from 3 devices, limit is 2"
+				user.AddStrike(models.Strike{Time: now, Level: 1, Penalty: "disable:1h", Reason: user.DisabledReason})
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("UpdateUser() error = %v", err)
+			}
+
+			user := getUser(t, store, "3.bob")
+			if !user.Disabled() || !user.DisabledUntil.Equal(until) || user.DisabledReason != "connected from 3 devices, limit is 2" {
+				t.Errorf("disabled at %v until %v (%q), want until %v", user.DisabledAt, user.DisabledUntil, user.DisabledReason, until)
+			}
+			if last := user.LastStrike(); user.Strikes != 1 || last == nil || !last.Time.Equal(now) || last.Penalty != "disable:1h" {
+				t.Errorf("strikes = %d, last strike = %+v, want 1 strike with disable:1h", user.Strikes, last)
+			}
+			if len(user.ActiveIPs) != 1 {
+				t.Errorf("ActiveIPs = %+v, want the IP to be kept", user.ActiveIPs)
+			}
+		})
+	}
+}
+
+func TestAudit(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			start := time.Now().UTC().Truncate(time.Second)
+			east, west := time.FixedZone("UTC+5", 5*60*60), time.FixedZone("UTC-5", -5*60*60)
+			entries := []models.AuditEntry{
+				{Time: start, Actor: "watchdog", Action: "user.disable", Target: "12.alice", Result: "ok"},
+				{Time: start.Add(time.Second), Actor: "api", Action: "ip.block", Target: "1.2.3.4", Result: "ok"},
+				{Time: start.Add(2 * time.Second), Actor: "watchdog", Action: "user.enable", Target: "12.alice", Result: "ok"},
+			}
+			for _, entry := range entries {
+				if err := store.AppendAudit(entry); err != nil {
+					t.Fatalf("AppendAudit() error = %v", err)
+				}
+			}
+
+			tests := []struct {
+				name   string
+				filter storage.AuditFilter
+				want   []string
+			}{
+				{"all", storage.AuditFilter{}, []string{"user.enable", "ip.block", "user.disable"}},
+				{"target", storage.AuditFilter{Target: "12.alice"}, []string{"user.enable", "user.disable"}},
+				{"actor and action", storage.AuditFilter{Actor: "api", Action: "ip.block"}, []string{"ip.block"}},
+				{"since and until", storage.AuditFilter{Since: start.Add(time.Second), Until: start.Add(time.Second)}, []string{"ip.block"}},
+				{"bounds in other time zones", storage.AuditFilter{Since: start.Add(time.Second).In(east), Until: start.Add(time.Second).In(west)}, []string{"ip.block"}},
+				{"limit", storage.AuditFilter{Limit: 1}, []string{"user.enable"}},
+			}
+			for _, tt := range tests {
+				got, err := store.ListAudit(tt.filter)
+				if err != nil {
+					t.Fatalf("ListAudit(%s) error = %v", tt.name, err)
+				}
+				var actions []string
+				for _, entry := range got {
+					actions = append(actions, entry.Action)
+				}
+				if !slices.Equal(actions, tt.want) {
+					t.Errorf("ListAudit(%s) = %v, want %v", tt.name, actions, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONUpgrade(t *testing.T) {
+	dir := t.TempDir()
+	usersPath := filepath.Join(dir, "users.json")
+	// Written before limits were kept per user, every limit is a copy of the
+	// global one
+	legacy := `[{"email":"12.alice","active_ips":["1.2.3.4"],"limit":2}]`
+	if err := os.WriteFile(usersPath, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store := storage.NewJSONStore(usersPath, filepath.Join(dir, "blocked_ips.json"), filepath.Join(dir, "api_keys.json"), filepath.Join(dir, "audit.jsonl"))
+
+	if err := store.Upgrade(); err != nil {
+		t.Fatalf("Upgrade() error = %v", err)
+	}
+	user := getUser(t, store, "12.alice")
+	if user.Limit != nil || len(user.ActiveIPs) != 1 {
+		t.Fatalf("Limit = %v, ActiveIPs = %+v, want the limit cleared and the IP kept", user.Limit, user.ActiveIPs)
+	}
+
+	// Limits set afterwards are kept by later starts
+	err := store.UpdateUser("12.alice", func(user *models.User) error {
+		limit := 3
+		user.Limit = &limit
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateUser() error = %v", err)
+	}
+	if err := store.Upgrade(); err != nil {
+		t.Fatalf("Upgrade() error = %v", err)
+	}
+	if user := getUser(t, store, "12.alice"); user.Limit == nil || *user.Limit != 3 {
+		t.Errorf("Limit = %v after a second upgrade, want 3", user.Limit)
+	}
+}
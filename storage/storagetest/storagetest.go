@@ -0,0 +1,29 @@
+// Package storagetest provides storage backends for tests. Each store lives in
+// a temporary directory, it is closed and removed when the test ends.
+package storagetest
+
+import (
+	"path/filepath"
+	"testing"
+	"watchdog/storage"
+)
+
+// NewJSONStore returns an empty JSON store
+func NewJSONStore(t testing.TB) *storage.JSONStore {
+	t.Helper()
+	dir := t.TempDir()
+	store := storage.NewJSONStore(filepath.Join(dir, "users.json"), filepath.Join(dir, "blocked_ips.json"), filepath.Join(dir, "api_keys.json"), filepath.Join(dir, "audit.jsonl"))
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// NewSQLiteStore returns an empty SQLite store
+func NewSQLiteStore(t testing.TB) *storage.SQLStore {
+	t.Helper()
+	store, err := storage.NewSQLiteStore(filepath.Join(t.TempDir(), "watchdog.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteStore() error = %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"log/slog"
+	"watchdog/models"
+)
+
+// upgrade is a one-time change to the users stored by the JSON and Redis
+// backends. They keep whole records instead of a schema, so they need no
+// migrations, but data written by older versions sometimes has to be fixed.
+// The SQL backends make the same changes in their migrations.
+type upgrade struct {
+	version int
+	name    string
+	// user changes one user and reports whether it did
+	user func(user *models.User) bool
+}
+
+// upgrades must only ever be appended to
+var upgrades = []upgrade{
+	{
+		version: 1,
+		name:    "clear user limits copied from MAX_ALLOW_USERS",
+		user: func(user *models.User) bool {
+			// Until now every user IP overwrote the limit with the global
+			// one, so no stored limit was set on purpose
+			changed := user.Limit != nil
+			user.Limit = nil
+			return changed
+		},
+	},
+}
+
+// dataVersion is the version of the data written by this version
+func dataVersion() int {
+	return upgrades[len(upgrades)-1].version
+}
+
+// upgradeUser applies the upgrades newer than version to user and reports
+// whether it changed
+func upgradeUser(user *models.User, version int) bool {
+	changed := false
+	for _, u := range upgrades {
+		if u.version > version && u.user(user) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// logUpgrades logs the upgrades newer than version
+func logUpgrades(version, users int) {
+	for _, u := range upgrades {
+		if u.version > version {
+			slog.Info("Applied upgrade", "version", u.version, "name", u.name, "users", users)
+		}
+	}
+}
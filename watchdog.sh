@@ -70,6 +70,7 @@ handle_action() {
     case ${options[$selected]} in
         "Uninstall")
             echo -e "${YELLOW}Uninstalling...${NC}"
+            docker-compose exec watchdog ./main -firewall-teardown
             docker-compose down
             echo -e "${GREEN}Uninstallation complete.${NC}"
             ;;
@@ -203,6 +204,7 @@ while true; do
             case ${options[selected_option]} in
                 "Uninstall")
                     echo -e "${MAGENTA}Uninstalling...${NC}"
+                    docker-compose exec watchdog ./main -firewall-teardown
                     docker-compose down
                     echo -e "${GREEN}Uninstallation complete.${NC}"
                     ;;
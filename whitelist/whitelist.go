@@ -0,0 +1,173 @@
+// Package whitelist decides which addresses Watchdog must never count as a
+// user device or block: our own probes, office NAT addresses and so on.
+package whitelist
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"watchdog/logging"
+)
+
+// Whitelist holds IPs, CIDRs and domains. Domains are resolved to IPs by
+// Refresh, which Run calls periodically so that DNS changes are picked up.
+type Whitelist struct {
+	resolver *net.Resolver
+
+	mu       sync.RWMutex
+	prefixes []netip.Prefix
+	domains  []string
+	resolved map[string][]netip.Addr
+}
+
+// Parse builds a whitelist from a comma-separated list of IPs, CIDRs and
+// domains, like WHITELIST_ADDRESSES. Domains are resolved once before it
+// returns; a domain that does not resolve yet is logged and retried later.
+func Parse(list string) (*Whitelist, error) {
+	w := &Whitelist{
+		resolver: net.DefaultResolver,
+		resolved: make(map[string][]netip.Addr),
+	}
+	if err := w.Update(list); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Update replaces the entries with list, in the format of Parse. On an
+// invalid list the whitelist is left unchanged.
+func (w *Whitelist) Update(list string) error {
+	var prefixes []netip.Prefix
+	var domains []string
+	var invalid []string
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(entry); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+		} else if isDomain(entry) {
+			domains = append(domains, strings.ToLower(strings.TrimSuffix(entry, ".")))
+		} else {
+			invalid = append(invalid, entry)
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("invalid whitelist entries: %s", strings.Join(invalid, ", "))
+	}
+
+	w.mu.Lock()
+	w.prefixes = prefixes
+	w.domains = domains
+	for domain := range w.resolved {
+		if !slices.Contains(domains, domain) {
+			delete(w.resolved, domain)
+		}
+	}
+	w.mu.Unlock()
+
+	w.Refresh(context.Background())
+	return nil
+}
+
+// Contains reports whether ip is whitelisted. Invalid IPs are not.
+func (w *Whitelist) Contains(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for _, prefix := range w.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	for _, addrs := range w.resolved {
+		for _, resolved := range addrs {
+			if resolved == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Refresh resolves the whitelisted domains again. A domain that fails to
+// resolve keeps its previous addresses.
+func (w *Whitelist) Refresh(ctx context.Context) {
+	w.mu.RLock()
+	domains := w.domains
+	w.mu.RUnlock()
+
+	for _, domain := range domains {
+		lookupCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		addrs, err := w.resolver.LookupNetIP(lookupCtx, "ip", domain)
+		cancel()
+		if err != nil {
+			slog.Warn("Whitelist: failed to resolve domain", "domain", domain, logging.KeyError, err)
+			continue
+		}
+		for i := range addrs {
+			addrs[i] = addrs[i].Unmap()
+		}
+
+		w.mu.Lock()
+		if slices.Contains(w.domains, domain) {
+			w.resolved[domain] = addrs
+		}
+		w.mu.Unlock()
+	}
+}
+
+// Run refreshes the domains every interval until ctx is done
+func (w *Whitelist) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.Refresh(ctx)
+		}
+	}
+}
+
+// isDomain reports whether s looks like a host name
+func isDomain(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if len(s) == 0 || len(s) > 253 {
+		return false
+	}
+	labels := strings.Split(s, ".")
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		return false // a mistyped IP address, not a domain
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+package wsclient
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+	"watchdog/logging"
+	"watchdog/marzban"
+)
+
+// Manager runs the log streams of the panel's core and of every Marzban
+// node, each with its own Client
+type Manager struct {
+	opts  Options
+	panel *marzban.Client
+
+	// wg tracks the running streams
+	wg sync.WaitGroup
+
+	mu      sync.Mutex
+	refresh time.Duration
+	core    *Client
+	nodes   map[int]*nodeStream
+}
+
+// nodeStream is the stream of one node and how to stop it
+type nodeStream struct {
+	client *Client
+	cancel context.CancelFunc
+}
+
+// NewManager returns a Manager that lists the nodes through panel every
+// refresh
+func NewManager(opts Options, panel *marzban.Client, refresh time.Duration) *Manager {
+	return &Manager{
+		opts:    opts,
+		panel:   panel,
+		refresh: refresh,
+		core:    NewClient(opts, CoreLogsPath, CoreNode),
+		nodes:   make(map[int]*nodeStream),
+	}
+}
+
+// Reconfigure changes the log interval of every stream and how often the
+// node list is fetched
+func (m *Manager) Reconfigure(interval int, refresh time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.opts.Interval = interval
+	m.refresh = refresh
+	m.core.Reconfigure(interval)
+	for _, stream := range m.nodes {
+		stream.client.Reconfigure(interval)
+	}
+}
+
+// Run streams the core logs and the logs of every node until ctx is done.
+// Streams are started for new nodes and stopped for removed or disabled ones
+// whenever the node list is fetched. Run returns once every stream has
+// stopped.
+func (m *Manager) Run(ctx context.Context) {
+	defer m.wg.Wait()
+	m.start(ctx, m.core)
+
+	for {
+		nodes, err := m.panel.Nodes()
+		if err != nil {
+			slog.Error("Failed to list Marzban nodes", logging.KeyError, err)
+		} else {
+			m.syncNodes(ctx, nodes)
+		}
+
+		m.mu.Lock()
+		refresh := m.refresh
+		m.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(refresh):
+		}
+	}
+}
+
+// States returns the state of every stream, the core first and then the
+// nodes by name
+func (m *Manager) States() []State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	states := make([]State, 0, len(m.nodes)+1)
+	for _, stream := range m.nodes {
+		states = append(states, stream.client.State())
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Node < states[j].Node })
+	return append([]State{m.core.State()}, states...)
+}
+
+// start runs the stream of client until ctx is done
+func (m *Manager) start(ctx context.Context, client *Client) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		client.Run(ctx)
+	}()
+}
+
+// syncNodes starts and stops streams so that exactly the enabled nodes are
+// streamed
+func (m *Manager) syncNodes(ctx context.Context, nodes []marzban.Node) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	enabled := make(map[int]bool)
+	for _, node := range nodes {
+		if node.Status == marzban.NodeDisabled {
+			continue
+		}
+		enabled[node.ID] = true
+		if _, ok := m.nodes[node.ID]; ok {
+			continue
+		}
+
+		slog.Info("Streaming logs of node", logging.KeyNode, node.Name, "node_id", node.ID)
+		nodeCtx, cancel := context.WithCancel(ctx)
+		client := NewClient(m.opts, NodeLogsPath(node.ID), node.Name)
+		m.nodes[node.ID] = &nodeStream{client: client, cancel: cancel}
+		m.start(nodeCtx, client)
+	}
+
+	for id, stream := range m.nodes {
+		if !enabled[id] {
+			slog.Info("Stopped streaming logs of node", logging.KeyNode, stream.client.node, "node_id", id)
+			stream.cancel()
+			delete(m.nodes, id)
+		}
+	}
+}
@@ -1,212 +1,329 @@
 package wsclient
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math/rand/v2"
 	"net/http"
-	"net/url"
-	"os"
-	"regexp"
-	"watchdog/handlers"
+	"strings"
+	"sync"
+	"time"
+	"watchdog/geoip"
+	"watchdog/logging"
+	"watchdog/marzban"
+	"watchdog/metrics"
 	"watchdog/models"
+	"watchdog/storage"
+	"watchdog/whitelist"
+	"watchdog/xraylog"
 
 	"github.com/gorilla/websocket"
 )
 
-// Structure for the token response
-type TokenResponse struct {
-    AccessToken string `json:"access_token"`
-}
-
-// Function to get the token by sending admin credentials
-func GetToken() (string, error) {
-    address := os.Getenv("ADDRESS")
-    port := os.Getenv("PORT_ADDRESS")
-    // Construct the token URL
-    tokenURL := fmt.Sprintf("http://%s:%s/api/admin/token", address, port)
-
-    data := url.Values{}
-    data.Set("grant_type", "password")
-    data.Set("username", os.Getenv("P_USER")) // Load from .env
-    data.Set("password", os.Getenv("P_PASS")) // Load from .env
-    data.Set("scope", "")
-    data.Set("client_id", "")
-    data.Set("client_secret", "")
-
-    resp, err := http.PostForm(tokenURL, data)
-    if err != nil {
-        return "", err
-    }
-    defer resp.Body.Close()
-
-    if resp.StatusCode != http.StatusOK {
-        return "", fmt.Errorf("failed to authenticate: %s", resp.Status)
-    }
-
-    var tokenResponse TokenResponse
-    if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
-        return "", err
-    }
-
-    return tokenResponse.AccessToken, nil
-}
-
-// Function to connect to WebSocket with token
-func ConnectToWebSocket(token string) {
-    // Check if SSL is enabled by checking if SSL is set to "true"
-    ssl := os.Getenv("SSL") == "true"
-    address := os.Getenv("ADDRESS")
-    port := os.Getenv("PORT_ADDRESS")
-    serverURL := fmt.Sprintf("%s:%s", address, port) // Store URL in .env
-    interval := os.Getenv("LOG_INTERVAL") // Log interval from .env
-    if interval == "" {
-        interval = "5"
-    }
-
-    // Construct the WebSocket URL based on SSL flag
-    wsURL := fmt.Sprintf("%s://%s/api/core/logs?interval=%s",
-        map[bool]string{true: "wss", false: "ws"}[ssl], serverURL, interval)
-
-    headers := http.Header{}
-    headers.Add("Authorization", "Bearer "+token)
-
-    log.Printf("Connecting to WebSocket at %s", wsURL)
-    c, _, err := websocket.DefaultDialer.Dial(wsURL, headers)
-    if err != nil {
-        log.Printf("Connection error: %v", err)
-        return
-    }
-    defer c.Close()
-
-    // Send initial message
-    err = c.WriteMessage(websocket.TextMessage, []byte("Hello, Server!"))
-    if err != nil {
-        log.Fatalf("Error sending message: %v", err)
-        return
-    }
-
-    // Continuously read messages
-    for {
-        _, message, err := c.ReadMessage()
-        if err != nil {
-            log.Printf("Error reading message: %v", err)
-            return
-        }
-        parseMessage(string(message))
-    }
-}
-
-
-// parseMessage extracts IP and email using regex
-func parseMessage(message string) (string, string) {
-    ipRegex := regexp.MustCompile(`([0-9]+\.[0-9]+\.[0-9]+\.[0-9]+)`)
-    emailRegex := regexp.MustCompile(`email:\s*([^\s]+)`)
-
-    ipMatch := ipRegex.FindStringSubmatch(message)
-    emailMatch := emailRegex.FindStringSubmatch(message)
-
-    if len(ipMatch) < 2 || len(emailMatch) < 2 {
-        return "", ""
-    }
-    sendToStorage(ipMatch[1], emailMatch[1])
-    return ipMatch[1], emailMatch[1]
-}
-
-// sendToStorage sends the extracted data, LIMIT, email, and ActiveIPs to the /api/user/add endpoint at port 4000
-func sendToStorage(ip, email string) {
-    storageType := os.Getenv("STORAGE_TYPE")
-    if storageType == "" {
-        log.Fatal("STORAGE_TYPE environment variable is not set")
-    }
-
-    limitStr := os.Getenv("MAX_ALLOW_USERS")
-    limit := 0
-    if limitStr != "" {
-        if _, err := fmt.Sscanf(limitStr, "%d", &limit); err != nil {
-            log.Printf("Error parsing LIMIT: %v", err)
-            return
-        }
-    }
-
-    var user models.User
-
-    // Retrieve existing user data from storage
-    switch storageType {
-    // case "redis":
-    //     if err := handlers.GetUserRedis(email, &user); err != nil {
-    //         log.Printf("Error retrieving user from Redis: %v", err)
-    //     }
-
-    case "json":
-        if err := handlers.GetUserJSON(email, &user); err != nil {
-            log.Printf("Error retrieving user from JSON: %v", err)
-        }
-
-    // case "sqlite":
-    //     if err := handlers.GetUserSQLite(email, &user); err != nil {
-    //         log.Printf("Error retrieving user from SQLite: %v", err)
-    //     }
-
-    default:
-        log.Printf("Unknown storage type: %s", storageType)
-        return
-    }
-
-    // Add new IP to the ActiveIPs slice if it doesn't already exist
-    if !contains(user.ActiveIPs, ip) {
-        user.ActiveIPs = append([]string{ip}, user.ActiveIPs...) // Add new IP at the beginning
-    } else {
-        log.Printf("IP %s is already in the user's active IPs.", ip)
-    }
-
-    user.Email = email
-    user.Limit = limit // Update limit if necessary
-
-    // Store updated user data back to storage
-    switch storageType {
-    // case "redis":
-    //     if err := handlers.AddUserRedis(&user,ip); err != nil {
-    //         log.Printf("Error storing user in Redis: %v", err)
-    //     } else {
-    //         log.Println("User successfully stored in Redis.")
-    //     }
-
-    case "json":
-        if err := handlers.AddUserJSON(&user,ip); err != nil {
-            log.Printf("Error storing user in JSON: %v", err)
-        } else {
-            log.Println("User successfully stored in JSON.")
-        }
-
-    // case "sqlite":
-    //     if err := handlers.AddUserSQLite(db,&user); err != nil {
-    //         log.Printf("Error storing user in SQLite: %v", err)
-    //     } else {
-    //         log.Println("User successfully stored in SQLite.")
-    //     }
-
-    default:
-        log.Printf("Unknown storage type: %s", storageType)
-    }
-
-    // Optionally, you can marshal the user data to JSON after storage
-    jsonData, err := json.Marshal(user)
-    if err != nil {
-        log.Printf("Error marshalling JSON: %v", err)
-        return
-    }
-
-    // For demonstration, just logging the marshaled JSON data
-    log.Printf("User data in JSON format: %s\n", jsonData)
-}
-
-// Helper function to check if an IP is already in the ActiveIPs slice
-func contains(slice []string, ip string) bool {
-    for _, item := range slice {
-        if item == ip {
-            return true
-        }
-    }
-    return false
-}
\ No newline at end of file
+// closeUnauthorized is the close code Marzban sends when it rejects the
+// token of a log stream
+const closeUnauthorized = 4401
+
+// CoreNode tags the records of the panel's own Xray core
+const CoreNode = "core"
+
+// CoreLogsPath is the log stream of the panel's own Xray core
+const CoreLogsPath = "/api/core/logs"
+
+// NodeLogsPath returns the log stream of the Marzban node with the given ID
+func NodeLogsPath(id int) string {
+	return fmt.Sprintf("/api/node/%d/logs", id)
+}
+
+// Keepalive timings: the panel must answer a ping, or send a message, within
+// pongWait, otherwise the connection is considered dead
+const (
+	pongWait   = 60 * time.Second
+	pingPeriod = pongWait * 9 / 10
+	writeWait  = 10 * time.Second
+)
+
+// Reconnect backoff: the delay doubles after every failed attempt up to
+// maxBackoff and is reset once a connection stayed up for maxBackoff
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// State describes the connection of one log stream
+type State struct {
+	Node           string     `json:"node"`
+	Connected      bool       `json:"connected"`
+	ConnectedSince *time.Time `json:"connected_since,omitempty"`
+	Reconnects     int        `json:"reconnects"`
+	LastMessage    *time.Time `json:"last_message,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+// Options are shared by the clients of every stream
+type Options struct {
+	// URL is the WebSocket base URL of the panel, e.g. "wss://panel.example.com:8000"
+	URL string
+	// Interval is how often, in seconds, the panel sends new log lines
+	Interval  int
+	Tokens    *marzban.TokenManager
+	Store     storage.Store
+	Whitelist *whitelist.Whitelist
+	// GeoIP, when not nil, locates the stored IPs
+	GeoIP *geoip.Locator
+	// OnDisconnect, when not nil, is called when a connected stream drops.
+	// Failed attempts to connect again do not call it.
+	OnDisconnect func(node string)
+	// OnReconnect, when not nil, is called when a stream that dropped is
+	// connected again
+	OnReconnect func(node string)
+}
+
+// Client streams the logs of one Marzban core or node and stores the devices
+// it reads from them
+type Client struct {
+	opts Options
+	path string
+	node string
+
+	// mu guards state, dropped and the reloadable Interval of opts
+	mu    sync.Mutex
+	state State
+	// dropped is set when a connected stream drops, until it is connected
+	// again
+	dropped bool
+}
+
+// NewClient returns a Client for the logs at path, e.g. CoreLogsPath, which
+// tags every record with node
+func NewClient(opts Options, path, node string) *Client {
+	return &Client{
+		opts:  opts,
+		path:  path,
+		node:  node,
+		state: State{Node: node},
+	}
+}
+
+// Reconfigure changes the log interval, which applies from the next
+// connection
+func (c *Client) Reconfigure(interval int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.opts.Interval = interval
+}
+
+// State returns the current connection state
+func (c *Client) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// Run keeps the stream connected until ctx is done. After a dropped
+// connection it waits with exponential backoff and jitter before connecting
+// again.
+func (c *Client) Run(ctx context.Context) {
+	backoff := minBackoff
+	for {
+		started := time.Now()
+		err := c.connect(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("Log stream closed", logging.KeyNode, c.node, logging.KeyError, err)
+		if c.disconnected(err) && c.opts.OnDisconnect != nil {
+			c.opts.OnDisconnect(c.node)
+		}
+
+		if time.Since(started) >= maxBackoff {
+			backoff = minBackoff
+		}
+		delay := jitter(backoff)
+		slog.Info("Reconnecting", logging.KeyNode, c.node, "delay", delay.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// connect streams the logs over one connection. It returns why the
+// connection ended. A token the panel rejects is invalidated, so the next
+// connection logs in again.
+func (c *Client) connect(ctx context.Context) error {
+	token, err := c.opts.Tokens.Token()
+	if err != nil {
+		return fmt.Errorf("failed to get token: %w", err)
+	}
+
+	c.mu.Lock()
+	interval := c.opts.Interval
+	c.mu.Unlock()
+	wsURL := fmt.Sprintf("%s%s?interval=%d", c.opts.URL, c.path, interval)
+
+	headers := http.Header{}
+	headers.Add("Authorization", "Bearer "+token)
+
+	slog.Info("Connecting to log stream", logging.KeyNode, c.node, "url", wsURL)
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, wsURL, headers)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			c.opts.Tokens.Invalidate(token)
+		}
+		return fmt.Errorf("connection error: %w", err)
+	}
+	defer conn.Close()
+
+	// When the stream is stopped, tell the panel and unblock ReadMessage. The
+	// message being read is stored first.
+	stop := context.AfterFunc(ctx, func() {
+		closing := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(writeWait))
+		conn.Close()
+	})
+	defer stop()
+
+	// Send initial message
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("Hello, Server!")); err != nil {
+		return fmt.Errorf("error sending message: %w", err)
+	}
+	if c.connected() && c.opts.OnReconnect != nil {
+		c.opts.OnReconnect(c.node)
+	}
+
+	// Any message or pong proves the connection is alive
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	go ping(conn, done)
+
+	// Continuously read messages
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, closeUnauthorized, websocket.ClosePolicyViolation) {
+				c.opts.Tokens.Invalidate(token)
+			}
+			return fmt.Errorf("error reading message: %w", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.received()
+		c.parseMessage(string(message))
+	}
+}
+
+// ping sends a ping every pingPeriod until done is closed
+func ping(conn *websocket.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return // the read loop notices the broken connection
+			}
+		}
+	}
+}
+
+// connected records an established connection and reports whether it
+// brings back a stream that dropped
+func (c *Client) connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.state.Connected = true
+	c.state.ConnectedSince = &now
+	c.state.LastError = ""
+	recovered := c.dropped
+	c.dropped = false
+	return recovered
+}
+
+func (c *Client) received() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.state.LastMessage = &now
+}
+
+// disconnected records a connection that ended or failed and reports whether
+// the stream was connected until now
+func (c *Client) disconnected(err error) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wasConnected := c.state.Connected
+	if wasConnected {
+		c.dropped = true
+	}
+	c.state.Connected = false
+	c.state.ConnectedSince = nil
+	c.state.Reconnects++
+	metrics.Reconnects.WithLabelValues(c.node).Inc()
+	if err != nil {
+		c.state.LastError = err.Error()
+	}
+	return wasConnected
+}
+
+// jitter returns a random delay between half of d and d, so that streams
+// that dropped together do not reconnect together
+func jitter(d time.Duration) time.Duration {
+	return d/2 + rand.N(d/2+1)
+}
+
+// parseMessage parses the access log lines in a message and stores the
+// source IP of every accepted connection that has a user email. Whitelisted
+// IPs are not stored as user devices.
+func (c *Client) parseMessage(message string) {
+	for _, line := range strings.Split(message, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		metrics.LogLines.WithLabelValues(c.node).Inc()
+		rec, err := xraylog.Parse(line)
+		if errors.Is(err, xraylog.ErrNotAccessLog) {
+			continue
+		}
+		if err != nil {
+			metrics.ParseFailures.WithLabelValues(c.node).Inc()
+			slog.Warn("Error parsing log line", logging.KeyNode, c.node, "line", line, logging.KeyError, err)
+			continue
+		}
+		metrics.LogLinesParsed.WithLabelValues(c.node).Inc()
+		rec.Node = c.node
+		if !rec.Accepted() || rec.Email == "" {
+			continue
+		}
+
+		ip := rec.Source.Addr().String()
+		if c.opts.Whitelist.Contains(ip) {
+			continue
+		}
+		sendToStorage(c.opts.Store, ip, c.opts.GeoIP.Locate(ip), rec.Email, rec.Node)
+	}
+}
+
+// sendToStorage records ip, located at geo, as an active IP of the user with
+// the given email. Users are shared by all nodes, so their limit applies
+// across the cluster.
+func sendToStorage(store storage.Store, ip string, geo *models.Geo, email, node string) {
+	user := models.User{Email: email}
+	if err := store.UpsertUserIP(&user, ip, geo); err != nil {
+		slog.Error("Error storing user IP", logging.KeyUser, email, logging.KeyIP, ip, logging.KeyNode, node, logging.KeyError, err)
+		return
+	}
+	slog.Debug("User IP seen", logging.KeyUser, email, logging.KeyIP, ip, logging.KeyNode, node, "ips", len(user.ActiveIPs))
+}
@@ -0,0 +1,101 @@
+package wsclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"watchdog/marzban"
+	"watchdog/storage/storagetest"
+
+	"github.com/gorilla/websocket"
+)
+
+// flakyPanel serves the core log stream of a panel that drops the first
+// connection and fails the attempt after it
+type flakyPanel struct {
+	mu       sync.Mutex
+	attempts int
+}
+
+func (p *flakyPanel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/api/admin/token" {
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "token"})
+		return
+	}
+	p.mu.Lock()
+	p.attempts++
+	attempt := p.attempts
+	p.mu.Unlock()
+
+	if attempt == 2 {
+		http.Error(w, "node is restarting", http.StatusBadGateway)
+		return
+	}
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	// Drop the first connection after its greeting, keep the later ones
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil || attempt == 1 {
+			return
+		}
+	}
+}
+
+func TestRunCallbacks(t *testing.T) {
+	panel := &flakyPanel{}
+	server := httptest.NewServer(panel)
+	t.Cleanup(server.Close)
+
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) func(node string) {
+		return func(node string) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, event+" "+node)
+		}
+	}
+	client := NewClient(Options{
+		URL:          "ws" + strings.TrimPrefix(server.URL, "http"),
+		Interval:     1,
+		Tokens:       marzban.NewTokenManager(server.URL, "admin", "secret", nil),
+		Store:        storagetest.NewJSONStore(t),
+		OnDisconnect: record("disconnect"),
+		OnReconnect:  record("reconnect"),
+	}, CoreLogsPath, CoreNode)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.Run(ctx)
+	}()
+
+	// The backoff waits up to a second after the drop and up to two after
+	// the failed attempt
+	deadline := time.Now().Add(5 * time.Second)
+	for !client.State().Connected || client.State().Reconnects < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("stream not connected again, state = %+v", client.State())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"disconnect core", "reconnect core"}; !slices.Equal(events, want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+}
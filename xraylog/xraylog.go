@@ -0,0 +1,187 @@
+// Package xraylog parses Xray access log lines, as streamed by Marzban's
+// log endpoints, into typed records.
+//
+// An access log line looks like one of
+//
+//	2024/10/16 12:34:56 1.2.3.4:54321 accepted tcp:www.google.com:443 [VLESS_TCP >> DIRECT] email: 12.alice
+//	2024/10/16 12:34:56.123456 from tcp:[2001:db8::1]:54321 accepted udp:8.8.8.8:53 [VMESS_WS -> DIRECT] email: 3.bob
+//	2024/10/16 12:34:56 1.2.3.4:54321 rejected  proxy/vless/encoding: invalid request user id
+package xraylog
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotAccessLog is returned for lines that are not access log entries,
+// such as Xray's error log lines which are streamed on the same socket
+var ErrNotAccessLog = errors.New("not an access log line")
+
+// Statuses of a connection
+const (
+	Accepted = "accepted"
+	Rejected = "rejected"
+)
+
+// timeLayouts are the timestamp formats written by Xray
+var timeLayouts = []string{
+	"2006/01/02 15:04:05.999999",
+	"2006/01/02 15:04:05",
+}
+
+// Record is one parsed access log line
+type Record struct {
+	Time time.Time
+	// Source is the client address
+	Source netip.AddrPort
+	// Status is Accepted or Rejected
+	Status string
+	// Network is "tcp" or "udp", empty for rejected connections without a destination
+	Network  string
+	DestHost string
+	DestPort uint16
+	Inbound  string
+	Outbound string
+	// Email is the Xray user email, empty when the line has none
+	Email string
+	// UserID and Username are Email split in Marzban's "<id>.<username>"
+	// format. UserID is 0 for emails in another format, Username is then
+	// the whole email.
+	UserID   int
+	Username string
+	// Reason is the text following a rejected connection
+	Reason string
+	// Node is the Marzban node whose log the line came from. Parse leaves it
+	// empty, the caller that knows the stream sets it.
+	Node string
+}
+
+// Accepted reports whether Xray accepted the connection
+func (r *Record) Accepted() bool {
+	return r.Status == Accepted
+}
+
+// Parse parses one access log line. Times are read in the local time zone,
+// like Xray writes them.
+func Parse(line string) (Record, error) {
+	var rec Record
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return rec, ErrNotAccessLog
+	}
+
+	t, err := parseTime(fields[0] + " " + fields[1])
+	if err != nil {
+		return rec, ErrNotAccessLog
+	}
+	rest := fields[2:]
+
+	if rest[0] == "from" {
+		rest = rest[1:]
+	}
+	if len(rest) < 2 || (rest[1] != Accepted && rest[1] != Rejected) {
+		return rec, ErrNotAccessLog
+	}
+	if rec.Source, err = parseSource(rest[0]); err != nil {
+		return rec, err
+	}
+	rec.Time = t
+	rec.Status = rest[1]
+	rest = rest[2:]
+
+	if len(rest) > 0 {
+		if network, host, port, ok := parseDestination(rest[0]); ok {
+			rec.Network, rec.DestHost, rec.DestPort = network, host, port
+			rest = rest[1:]
+		}
+	}
+
+	remainder := strings.Join(rest, " ")
+	if i := strings.Index(remainder, "email:"); i >= 0 {
+		if email := strings.Fields(remainder[i+len("email:"):]); len(email) > 0 {
+			rec.Email = email[0]
+			rec.UserID, rec.Username = ParseEmail(rec.Email)
+		}
+		remainder = strings.TrimSpace(remainder[:i])
+	}
+	if strings.HasPrefix(remainder, "[") {
+		if end := strings.Index(remainder, "]"); end > 0 {
+			rec.Inbound, rec.Outbound = parseRoute(remainder[1:end])
+			remainder = strings.TrimSpace(remainder[end+1:])
+		}
+	}
+	if rec.Status == Rejected {
+		rec.Reason = remainder
+	}
+	return rec, nil
+}
+
+// ParseEmail splits an email in Marzban's "<id>.<username>" format. For
+// other emails it returns 0 and the email itself.
+func ParseEmail(email string) (int, string) {
+	idPart, username, found := strings.Cut(email, ".")
+	if !found || username == "" {
+		return 0, email
+	}
+	id, err := strconv.Atoi(idPart)
+	if err != nil || id <= 0 || strings.TrimLeft(idPart, "0123456789") != "" {
+		return 0, email
+	}
+	return id, username
+}
+
+func parseTime(s string) (time.Time, error) {
+	var err error
+	for _, layout := range timeLayouts {
+		var t time.Time
+		if t, err = time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// parseSource parses "1.2.3.4:5678", "[::1]:5678" or either of them with a
+// "tcp:"/"udp:" prefix
+func parseSource(s string) (netip.AddrPort, error) {
+	if network, addr, found := strings.Cut(s, ":"); found && (network == "tcp" || network == "udp") {
+		s = addr
+	}
+	source, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return source, fmt.Errorf("invalid source address %q: %w", s, err)
+	}
+	return netip.AddrPortFrom(source.Addr().Unmap(), source.Port()), nil
+}
+
+// parseDestination parses "tcp:example.com:443" or "udp:[2001:db8::1]:53"
+func parseDestination(s string) (string, string, uint16, bool) {
+	network, hostPort, found := strings.Cut(s, ":")
+	if !found || (network != "tcp" && network != "udp") {
+		return "", "", 0, false
+	}
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", "", 0, false
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", "", 0, false
+	}
+	return network, host, uint16(port), true
+}
+
+// parseRoute splits "inbound >> outbound" (or "->") into its tags
+func parseRoute(s string) (string, string) {
+	for _, sep := range []string{">>", "->"} {
+		if inbound, outbound, found := strings.Cut(s, sep); found {
+			return strings.TrimSpace(inbound), strings.TrimSpace(outbound)
+		}
+	}
+	return strings.TrimSpace(s), ""
+}
@@ -0,0 +1,236 @@
+package xraylog
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want Record
+		// err is the expected error, any error when wantErr is set
+		err     error
+		wantErr bool
+	}{
+		{
+			name: "IPv4 source",
+			line: "2024/10/16 12:34:56 1.2.3.4:54321 accepted tcp:www.google.com:443 [VLESS_TCP >> DIRECT] email: 12.alice",
+			want: Record{
+				Time:     time.Date(2024, 10, 16, 12, 34, 56, 0, time.Local),
+				Source:   netip.MustParseAddrPort("1.2.3.4:54321"),
+				Status:   Accepted,
+				Network:  "tcp",
+				DestHost: "www.google.com",
+				DestPort: 443,
+				Inbound:  "VLESS_TCP",
+				Outbound: "DIRECT",
+				Email:    "12.alice",
+				UserID:   12,
+				Username: "alice",
+			},
+		},
+		{
+			name: "from prefix, bracketed IPv6 source and microseconds",
+			line: "2024/10/16 12:34:56.123456 from tcp:[2001:db8::1]:54321 accepted udp:8.8.8.8:53 [VMESS_WS -> DIRECT] email: 3.bob",
+			want: Record{
+				Time:     time.Date(2024, 10, 16, 12, 34, 56, 123456000, time.Local),
+				Source:   netip.MustParseAddrPort("[2001:db8::1]:54321"),
+				Status:   Accepted,
+				Network:  "udp",
+				DestHost: "8.8.8.8",
+				DestPort: 53,
+				Inbound:  "VMESS_WS",
+				Outbound: "DIRECT",
+				Email:    "3.bob",
+				UserID:   3,
+				Username: "bob",
+			},
+		},
+		{
+			name: "from prefix with IPv4 source",
+			line: "2024/10/16 12:34:56 from 10.0.0.7:1234 accepted tcp:example.com:80 [TROJAN >> DIRECT] email: 7.carol",
+			want: Record{
+				Time:     time.Date(2024, 10, 16, 12, 34, 56, 0, time.Local),
+				Source:   netip.MustParseAddrPort("10.0.0.7:1234"),
+				Status:   Accepted,
+				Network:  "tcp",
+				DestHost: "example.com",
+				DestPort: 80,
+				Inbound:  "TROJAN",
+				Outbound: "DIRECT",
+				Email:    "7.carol",
+				UserID:   7,
+				Username: "carol",
+			},
+		},
+		{
+			name: "IPv4-mapped IPv6 source and IPv6 destination",
+			line: "2024/10/16 12:34:56 [::ffff:1.2.3.4]:443 accepted tcp:[2001:db8::53]:853 [VLESS_REALITY >> IPv6] email: 5.dave",
+			want: Record{
+				Time:     time.Date(2024, 10, 16, 12, 34, 56, 0, time.Local),
+				Source:   netip.MustParseAddrPort("1.2.3.4:443"),
+				Status:   Accepted,
+				Network:  "tcp",
+				DestHost: "2001:db8::53",
+				DestPort: 853,
+				Inbound:  "VLESS_REALITY",
+				Outbound: "IPv6",
+				Email:    "5.dave",
+				UserID:   5,
+				Username: "dave",
+			},
+		},
+		{
+			name: "username with dots",
+			line: "2024/10/16 12:34:56 1.2.3.4:54321 accepted tcp:example.com:443 [VLESS_TCP >> DIRECT] email: 42.john.doe.2",
+			want: Record{
+				Time:     time.Date(2024, 10, 16, 12, 34, 56, 0, time.Local),
+				Source:   netip.MustParseAddrPort("1.2.3.4:54321"),
+				Status:   Accepted,
+				Network:  "tcp",
+				DestHost: "example.com",
+				DestPort: 443,
+				Inbound:  "VLESS_TCP",
+				Outbound: "DIRECT",
+				Email:    "42.john.doe.2",
+				UserID:   42,
+				Username: "john.doe.2",
+			},
+		},
+		{
+			name: "email without an ID",
+			line: "2024/10/16 12:34:56 1.2.3.4:54321 accepted tcp:example.com:443 [VLESS_TCP >> DIRECT] email: alice@example.com",
+			want: Record{
+				Time:     time.Date(2024, 10, 16, 12, 34, 56, 0, time.Local),
+				Source:   netip.MustParseAddrPort("1.2.3.4:54321"),
+				Status:   Accepted,
+				Network:  "tcp",
+				DestHost: "example.com",
+				DestPort: 443,
+				Inbound:  "VLESS_TCP",
+				Outbound: "DIRECT",
+				Email:    "alice@example.com",
+				Username: "alice@example.com",
+			},
+		},
+		{
+			name: "no email",
+			line: "2024/10/16 12:34:56 1.2.3.4:54321 accepted tcp:example.com:443 [api -> api]",
+			want: Record{
+				Time:     time.Date(2024, 10, 16, 12, 34, 56, 0, time.Local),
+				Source:   netip.MustParseAddrPort("1.2.3.4:54321"),
+				Status:   Accepted,
+				Network:  "tcp",
+				DestHost: "example.com",
+				DestPort: 443,
+				Inbound:  "api",
+				Outbound: "api",
+			},
+		},
+		{
+			name: "rejected",
+			line: "2024/10/16 12:34:56 1.2.3.4:54321 rejected  proxy/vless/encoding: invalid request user id",
+			want: Record{
+				Time:   time.Date(2024, 10, 16, 12, 34, 56, 0, time.Local),
+				Source: netip.MustParseAddrPort("1.2.3.4:54321"),
+				Status: Rejected,
+				Reason: "proxy/vless/encoding: invalid request user id",
+			},
+		},
+		{
+			name: "rejected with a destination",
+			line: "2024/10/16 12:34:56.5 from [2001:db8::2]:4000 rejected tcp:blocked.example:443 [VLESS_TCP >> BLOCK] email: 9.eve",
+			want: Record{
+				Time:     time.Date(2024, 10, 16, 12, 34, 56, 500000000, time.Local),
+				Source:   netip.MustParseAddrPort("[2001:db8::2]:4000"),
+				Status:   Rejected,
+				Network:  "tcp",
+				DestHost: "blocked.example",
+				DestPort: 443,
+				Inbound:  "VLESS_TCP",
+				Outbound: "BLOCK",
+				Email:    "9.eve",
+				UserID:   9,
+				Username: "eve",
+			},
+		},
+		{
+			name: "error log line",
+			line: "2024/10/16 12:34:56 [Info] [1234567890] proxy/vless/inbound: firstLen = 1024",
+			err:  ErrNotAccessLog,
+		},
+		{
+			name: "warning log line",
+			line: "2024/10/16 12:34:56.123456 [Warning] core: Xray 1.8.24 started",
+			err:  ErrNotAccessLog,
+		},
+		{
+			name: "no timestamp",
+			line: "Xray 1.8.24 (Xray, Penetrates Everything.) Custom (go1.22.5 linux/amd64)",
+			err:  ErrNotAccessLog,
+		},
+		{
+			name: "too short",
+			line: "2024/10/16 12:34:56",
+			err:  ErrNotAccessLog,
+		},
+		{
+			name:    "invalid source",
+			line:    "2024/10/16 12:34:56 not-an-ip:1 accepted tcp:example.com:443 [VLESS_TCP >> DIRECT] email: 1.a",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.line)
+			switch {
+			case tt.err != nil:
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("Parse() error = %v, want %v", err, tt.err)
+				}
+				return
+			case tt.wantErr:
+				if err == nil || errors.Is(err, ErrNotAccessLog) {
+					t.Fatalf("Parse() error = %v, want an invalid line error", err)
+				}
+				return
+			case err != nil:
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if !got.Time.Equal(tt.want.Time) {
+				t.Errorf("Time = %v, want %v", got.Time, tt.want.Time)
+			}
+			got.Time, tt.want.Time = time.Time{}, time.Time{}
+			if got != tt.want {
+				t.Errorf("Parse() = %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseEmail(t *testing.T) {
+	tests := []struct {
+		email    string
+		id       int
+		username string
+	}{
+		{"12.alice", 12, "alice"},
+		{"1.john.doe", 1, "john.doe"},
+		{"alice", 0, "alice"},
+		{"alice.smith", 0, "alice.smith"},
+		{"0.alice", 0, "0.alice"},
+		{"-3.alice", 0, "-3.alice"},
+		{"12.", 0, "12."},
+	}
+	for _, tt := range tests {
+		id, username := ParseEmail(tt.email)
+		if id != tt.id || username != tt.username {
+			t.Errorf("ParseEmail(%q) = %d, %q, want %d, %q", tt.email, id, username, tt.id, tt.username)
+		}
+	}
+}